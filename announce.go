@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"context"
+	b "dht/bencode"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// AnnounceInterval is how often Announce announces a torrent again,
+	// well before the peer expires from the nodes it was announced to.
+	AnnounceInterval = 15 * time.Minute
+)
+
+var ErrNotAnnounced = errors.New("dht: no node accepted the announce")
+
+// Announce announces that we are a peer of infohash listening on port, or on
+// the port our queries are sent from when impliedPort is set, to the nodes
+// closest to infohash. It announces again every AnnounceInterval until ctx is
+// done and then returns the error of ctx.
+func (s *Server) Announce(ctx context.Context, infohash b.String, port uint16, impliedPort bool) error {
+	t := time.NewTicker(s.announceInterval)
+	defer t.Stop()
+	for {
+		if _, err := s.announce(ctx, infohash, port, impliedPort); err != nil && ctx.Err() == nil {
+			log.Println("While announcing", hex.EncodeToString(infohash), err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// announce looks up the nodes closest to infohash to collect their tokens and
+// sends each of them an announce_peer query. It returns the number of nodes
+// that accepted the announce.
+func (s *Server) announce(ctx context.Context, infohash b.String, port uint16, impliedPort bool) (int, error) {
+	r, err := NewLookup(s, infohash, true).Run(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	accepted := s.queryAll(ctx, r.Closest, func(n LookupNode) KRPCMessage {
+		return &AnnouncePeerQuery{
+			ID:          s.id,
+			InfoHash:    infohash,
+			Token:       n.Token,
+			Port:        port,
+			ImpliedPort: impliedPort,
+		}
+	})
+	if accepted == 0 {
+		return 0, ErrNotAnnounced
+	}
+	return accepted, nil
+}
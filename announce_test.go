@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAnnounce(t *testing.T) {
+	servers, nodes := testNetwork(t, 30)
+	infohash := testID(nodes[10].ID[0], 0xff)
+	n, err := servers[0].announce(context.Background(), infohash, 6881, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != K {
+		t.Fatal("announce should be accepted by the k closest nodes", n)
+	}
+	r, err := NewLookup(servers[20], infohash, true).Run(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Peers) != 1 || r.Peers[0].String() != NewPeer(nodes[0].IP, 6881).String() {
+		t.Fatal("announced peer was not found", r.Peers)
+	}
+	empty, _ := testServers(t, 1)
+	if _, err := empty[0].announce(context.Background(), infohash, 6881, false); err != ErrNoNodes {
+		t.Fatal("announce without nodes should fail", err)
+	}
+}
+
+func TestAnnounceRepeats(t *testing.T) {
+	servers, nodes := testNetwork(t, 10)
+	infohash := testID(nodes[5].ID[0], 0xff)
+	clock := &testClock{now: time.Unix(0, 0)}
+	servers[5].now = clock.Now
+	servers[0].announceInterval = time.Millisecond
+	// announced returns when servers[5] last stored the peer of servers[0] at
+	// its implied port
+	announced := func() (time.Time, bool) {
+		servers[5].mu.Lock()
+		defer servers[5].mu.Unlock()
+		at, ok := servers[5].peers[infohash.Raw()][NewPeer(nodes[0].IP, uint16(nodes[0].Port())).String()]
+		return at, ok
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- servers[0].Announce(ctx, infohash, 0, true) }()
+	// wait for the first announce to reach the closest node and then for
+	// another one to refresh the peer
+	for _, after := range []time.Duration{0, time.Minute} {
+		clock.Add(after)
+		for at, ok := announced(); !ok || at != clock.Now(); at, ok = announced() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal("announce should stop when cancelled", err)
+	}
+}
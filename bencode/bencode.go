@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"math/big"
 	"reflect"
 	"sort"
 	"strconv"
@@ -39,6 +40,7 @@ type (
 		Bencode(*Writer) error
 		Unmarshal(dst reflect.Value) error
 		Pretty(ind, indInc string) string
+		AppendBencode(dst []byte) []byte
 		Bytes() []byte
 		String() string
 	}
@@ -75,55 +77,36 @@ func (w *Writer) Write(p []byte) *Writer {
 func mbytes(sz int) []byte { return make([]byte, sz) }
 func btobs(b byte) []byte  { return []byte{b} }
 
-func readUntil(r *Reader, b byte, app []byte) ([]byte, error) {
-	buf := mbytes(1)
-	for {
-		r.Read(buf)
-		if r.n > 0 {
-			if buf[0] == b {
-				return app, nil
-			} else {
-				app = append(app, buf[0])
-			}
-		} else if r.err != nil {
-			if r.err == io.EOF {
-				return app, errors.New("eof reached before byte was found")
-			}
-			return app, r.err
-		} else {
-			return app, errors.New("empty reader cannot be readUntil")
-		}
-	}
-}
-
 func parseInt(bs []byte) (int64, error) {
-	var val, mult, sign int64 = 0, 1, 1
-	if bs[0] == neg {
-		sign = -1
+	negative := len(bs) > 0 && bs[0] == neg
+	if negative {
 		bs = bs[1:]
 	}
 	if len(bs) == 0 {
 		return 0, errors.New("input was too short to be a valid number")
-	} else if len(bs) == 1 {
-		if bs[0] == num0 {
-			if sign == -1 {
-				return 0, errors.New("-0 is not a valid number")
-			}
-			return 0, nil // special case: num == 0
-		}
-	} else if bs[0] == num0 {
+	} else if len(bs) == 1 && bs[0] == num0 && negative {
+		return 0, errors.New("-0 is not a valid number")
+	} else if len(bs) > 1 && bs[0] == num0 {
 		return 0, errors.New("numbers aside from 0 with leading 0s are not valid numbers")
 	}
-	for i := len(bs) - 1; i >= 0; i-- {
-		switch b := bs[i]; b {
-		case num0, num1, num2, num3, num4, num5, num6, num7, num8, num9:
-			val += (int64(b-num0) * mult)
-			mult *= 10
-		default:
+	var val, limit uint64 = 0, math.MaxInt64
+	if negative {
+		limit++
+	}
+	for _, b := range bs {
+		if b < num0 || b > num9 {
 			return 0, errors.New("invalid character found when parsing int")
 		}
+		digit := uint64(b - num0)
+		if val > (limit-digit)/10 {
+			return 0, ErrIntOverflow
+		}
+		val = val*10 + digit
+	}
+	if negative {
+		return -int64(val), nil
 	}
-	return sign * val, nil
+	return int64(val), nil
 }
 
 const (
@@ -158,22 +141,33 @@ func (s String) Bencode(w *Writer) error {
 	return w.err
 }
 
+func (s String) AppendBencode(dst []byte) []byte {
+	dst = strconv.AppendInt(dst, int64(len(s)), 10)
+	dst = append(dst, stringSep)
+	return append(dst, s...)
+}
+
 func (s String) Unmarshal(dst reflect.Value) error {
-	if dst.Kind() != reflect.Ptr {
-		return errors.New("(String) can only unmarshal to ptr")
+	e, err := settable(dst, "String")
+	if err != nil {
+		return err
 	}
-	e := dst.Elem()
-	if !e.CanSet() {
-		return errors.New("(String) cannot set field")
+	if ok, err := unmarshalWith(e, s); ok {
+		return err
 	}
 	if e.Type() == reflect.TypeOf(S("")) {
 		e.Set(reflect.ValueOf(s))
-	} else {
+	} else if !setBencoder(e, s) {
 		switch k := e.Kind(); {
 		case k == reflect.String:
 			e.SetString(s.Raw())
-		case k == reflect.Slice && e.Elem().Kind() == reflect.Int8:
-			e.SetBytes(s)
+		case k == reflect.Slice && e.Type().Elem().Kind() == reflect.Uint8:
+			e.SetBytes(append(reflect.MakeSlice(e.Type(), 0, s.Len()).Bytes(), s...))
+		case k == reflect.Array && e.Type().Elem().Kind() == reflect.Uint8:
+			if e.Len() != s.Len() {
+				return errors.New("(String) length does not match array length")
+			}
+			reflect.Copy(e, reflect.ValueOf(s))
 		default:
 			return errors.New("(String) invalid type for field")
 		}
@@ -194,24 +188,14 @@ func (s String) Equal(o String) bool {
 }
 
 func (s String) Less(o String) bool {
-	for i := 0; i < len(s) && i < len(o); i++ {
-		sc, oc := s[i], o[i]
-		if sc < oc {
-			return true
-		} else if oc < sc {
-			return false
-		}
-	}
-	return len(s) < len(o)
+	return bytes.Compare(s, o) < 0
 }
 
 func (s String) Len() int { return len(s) }
 
-func (s String) Bytes() []byte {
-	buf := NewWriter(bytes.NewBuffer(mbytes(0)))
-	s.Bencode(buf)
-	return buf.Writer.(*bytes.Buffer).Bytes()
-}
+func (s String) Clone() String { return append(make(String, 0, len(s)), s...) }
+
+func (s String) Bytes() []byte { return s.AppendBencode(nil) }
 
 func (s String) String() string { return string(s.Bytes()) }
 
@@ -225,22 +209,38 @@ func (i Int) Bencode(w *Writer) error {
 	return w.err
 }
 
+func (i Int) AppendBencode(dst []byte) []byte {
+	dst = append(dst, intStart)
+	dst = strconv.AppendInt(dst, int64(i), 10)
+	return append(dst, end)
+}
+
 func (i Int) Unmarshal(dst reflect.Value) error {
-	if dst.Kind() != reflect.Ptr {
-		return errors.New("(Int) can only unmarshal to ptr")
+	e, err := settable(dst, "Int")
+	if err != nil {
+		return err
 	}
-	e := dst.Elem()
-	if !e.CanSet() {
-		return errors.New("(Int) cannot set field")
+	if ok, err := unmarshalWith(e, i); ok {
+		return err
 	}
 	if e.Type() == reflect.TypeOf(I(0)) {
 		e.Set(reflect.ValueOf(i))
-	} else {
+	} else if e.Type() == bigIntType {
+		e.Addr().Interface().(*big.Int).SetInt64(i.Raw())
+	} else if !setBencoder(e, i) {
 		switch k := e.Kind(); k {
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if e.OverflowInt(i.Raw()) {
+				return errors.New("(Int) value overflows field")
+			}
 			e.SetInt(i.Raw())
 		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if i < 0 || e.OverflowUint(uint64(i.Raw())) {
+				return errors.New("(Int) value overflows field")
+			}
 			e.SetUint(uint64(i.Raw()))
+		case reflect.Bool:
+			e.SetBool(i != 0)
 		default:
 			return errors.New("(Int) invalid type for field")
 		}
@@ -251,11 +251,7 @@ func (i Int) Unmarshal(dst reflect.Value) error {
 func (i Int) Pretty(ind, _ string) string { return ind + fmt.Sprint(i.Raw()) + "\n" }
 func (i Int) Raw() int64                  { return int64(i) }
 
-func (i Int) Bytes() []byte {
-	buf := NewWriter(bytes.NewBuffer(mbytes(0)))
-	i.Bencode(buf)
-	return buf.Writer.(*bytes.Buffer).Bytes()
-}
+func (i Int) Bytes() []byte { return i.AppendBencode(nil) }
 
 func (i Int) String() string { return string(i.Bytes()) }
 
@@ -270,18 +266,28 @@ func (l List) Bencode(w *Writer) error {
 	return w.err
 }
 
+func (l List) AppendBencode(dst []byte) []byte {
+	dst = append(dst, listStart)
+	for _, elem := range l {
+		dst = elem.AppendBencode(dst)
+	}
+	return append(dst, end)
+}
+
 func (l List) Unmarshal(dst reflect.Value) error {
-	if dst.Kind() != reflect.Ptr {
-		return errors.New("(List) can only unmarshal to ptr")
+	e, err := settable(dst, "List")
+	if err != nil {
+		return err
+	}
+	if ok, err := unmarshalWith(e, l); ok {
+		return err
 	}
-	e := dst.Elem()
 	if e.Type() == reflect.TypeOf(L()) {
-		if !e.CanSet() {
-			return errors.New("(List) cannot set field")
-		}
 		e.Set(reflect.ValueOf(l))
-	} else {
+	} else if !setBencoder(e, l) {
 		switch k := e.Kind(); k {
+		case reflect.Slice, reflect.Array:
+			return unmarshalToSlice(l, e)
 		case reflect.Struct:
 			if e.NumField() != l.Len() {
 				return errors.New("(List) struct does not have enough fields")
@@ -317,11 +323,7 @@ func (l List) Get(idx int) Bencoder {
 
 func (l List) Len() int { return len(l) }
 
-func (l List) Bytes() []byte {
-	buf := NewWriter(bytes.NewBuffer(mbytes(0)))
-	l.Bencode(buf)
-	return buf.Writer.(*bytes.Buffer).Bytes()
-}
+func (l List) Bytes() []byte { return l.AppendBencode(nil) }
 
 func (l List) String() string { return string(l.Bytes()) }
 
@@ -358,29 +360,32 @@ func (d Dict) Bencode(w *Writer) error {
 	return w.err
 }
 
+func (d Dict) AppendBencode(dst []byte) []byte {
+	dst = append(dst, dictStart)
+	for _, p := range d {
+		dst = p.Value.AppendBencode(p.Key.AppendBencode(dst))
+	}
+	return append(dst, end)
+}
+
 func (d Dict) Unmarshal(dst reflect.Value) error {
-	if dst.Kind() != reflect.Ptr {
-		return errors.New("(Dict) can only unmarshal to ptr")
+	e, err := settable(dst, "Dict")
+	if err != nil {
+		return err
+	}
+	if ok, err := unmarshalWith(e, d); ok {
+		return err
 	}
-	e := dst.Elem()
 	if e.Type() == reflect.TypeOf(D()) {
-		if !e.CanSet() {
-			return errors.New("(Dict) cannot set field")
-		}
 		e.Set(reflect.ValueOf(d))
-	} else {
+	} else if !setBencoder(e, d) {
 		switch k := e.Kind(); k {
 		case reflect.Struct:
-			if e.NumField() != d.Len() {
-				return errors.New("(Dict) struct does not have enough fields")
-			}
-			for i, val := range d {
-				if err := val.Value.Unmarshal(e.Field(i).Addr()); err != nil {
-					return err
-				}
-			}
+			return unmarshalToStruct(d, e)
+		case reflect.Map:
+			return unmarshalToMap(d, e)
 		default:
-			return errors.New("Dict) invalid type for field")
+			return errors.New("(Dict) invalid type for field")
 		}
 	}
 	return nil
@@ -400,6 +405,8 @@ func (d Dict) IndexOf(k String) int {
 	})
 }
 
+// Put returns a copy of d with k inserted in sorted order. It does not replace
+// an existing value for k, use Set for that.
 func (d Dict) Put(k String, v Bencoder) Dict {
 	idx := d.IndexOf(k)
 	ret := make(Dict, len(d)+1)
@@ -409,6 +416,59 @@ func (d Dict) Put(k String, v Bencoder) Dict {
 	return ret
 }
 
+func (d Dict) has(i int, k String) bool { return i < len(d) && d[i].Key.Equal(k) }
+
+// Set sets the value of k to v, replacing any existing value, and returns the
+// updated Dict. Like append it modifies d in place when it can, so the result
+// must be used in place of d.
+func (d Dict) Set(k String, v Bencoder) Dict {
+	idx := d.IndexOf(k)
+	if d.has(idx, k) {
+		d[idx].Value = v
+		return d
+	}
+	d = append(d, Pair{})
+	copy(d[idx+1:], d[idx:])
+	d[idx] = P(k, v)
+	return d
+}
+
+// Delete removes k from d, modifying it in place, and returns the updated Dict.
+func (d Dict) Delete(k String) Dict {
+	idx := d.IndexOf(k)
+	if !d.has(idx, k) {
+		return d
+	}
+	copy(d[idx:], d[idx+1:])
+	d[len(d)-1] = Pair{}
+	return d[:len(d)-1]
+}
+
+// Merge returns a new Dict holding the pairs of both d and o. The value from o
+// wins when both have the same key.
+func (d Dict) Merge(o Dict) Dict {
+	ret := make(Dict, 0, len(d)+len(o))
+	i, j := 0, 0
+	for i < len(d) && j < len(o) {
+		switch {
+		case d[i].Key.Less(o[j].Key):
+			ret = append(ret, d[i])
+			i++
+		case o[j].Key.Less(d[i].Key):
+			ret = append(ret, o[j])
+			j++
+		default:
+			ret = append(ret, o[j])
+			i, j = i+1, j+1
+		}
+	}
+	ret = append(ret, d[i:]...)
+	return append(ret, o[j:]...)
+}
+
+// Clone returns a deep copy of d.
+func (d Dict) Clone() Dict { return Clone(d).(Dict) }
+
 func (d Dict) Get(k String) Bencoder {
 	i := d.IndexOf(k)
 	if i >= d.Len() || i < 0 {
@@ -466,122 +526,107 @@ func (d Dict) GetDict(k String) (Dict, error) {
 	return nil, errors.New("value for key in dict was not a String")
 }
 
-func (d Dict) Bytes() []byte {
-	buf := NewWriter(bytes.NewBuffer(mbytes(0)))
-	d.Bencode(buf)
-	return buf.Writer.(*bytes.Buffer).Bytes()
-}
+func (d Dict) Bytes() []byte { return d.AppendBencode(nil) }
 
 func (d Dict) String() string { return string(d.Bytes()) }
 
-// Functions to handle decoding of types coming over the wire
+// DictBuilder collects pairs in any order and sorts them once when the Dict
+// is built, which is much cheaper than calling Set for every pair of a large
+// Dict.
+type DictBuilder struct {
+	pairs []Pair
+	order []int
+}
 
-func decodeString(r *Reader, fByte []byte) (String, error) {
-	strLenRaw, err := readUntil(r, stringSep, fByte)
-	if err != nil {
-		return nil, err
-	}
-	strLen, err := parseInt(strLenRaw)
-	if err != nil {
-		return nil, err
-	}
-	if strLen < 0 {
-		return nil, errors.New("string length must be positive or 0")
-	}
-	s := make(String, strLen)
-	r.Read(s)
-	if int64(r.n) == strLen {
-		return s, nil
-	} else {
-		log.Println("len", strLen, r.n)
-	}
-	if err != nil {
-		return s, err
-	}
-	return s, errors.New("full string could not be read")
+func NewDictBuilder(size int) *DictBuilder {
+	return &DictBuilder{make([]Pair, 0, size), make([]int, 0, size)}
 }
 
-func decodeInt(r *Reader) (Int, error) {
-	data, err := readUntil(r, end, mbytes(0))
-	if err != nil {
-		return 0, err
-	}
-	i, err := parseInt(data)
-	return Int(i), err
+func (b *DictBuilder) Add(k String, v Bencoder) *DictBuilder {
+	b.pairs = append(b.pairs, P(k, v))
+	b.order = append(b.order, len(b.order))
+	return b
 }
 
-func decodeList(r *Reader) (List, error) {
-	l := make(List, 0)
-	for {
-		b, err := decode(r)
-		if b == nil && err == nil {
-			return l, nil
-		} else if err == nil {
-			l = append(l, b)
-		} else {
-			return l, err
-		}
+func (b *DictBuilder) Len() int { return len(b.pairs) }
+
+// builderOrder sorts the pairs of a DictBuilder by key and then by when they
+// were added.
+type builderOrder DictBuilder
+
+func (b *builderOrder) Len() int { return len(b.pairs) }
+
+func (b *builderOrder) Less(i, j int) bool {
+	if c := bytes.Compare(b.pairs[i].Key, b.pairs[j].Key); c != 0 {
+		return c < 0
 	}
+	return b.order[i] < b.order[j]
 }
 
-func decodeDict(r *Reader) (Dict, error) {
-	d := make(Dict, 0)
-	for {
-		k, err := decode(r)
-		if k == nil && err == nil {
-			return d, nil
-		} else if err != nil {
-			return d, err
-		}
-		ks, ok := k.(String)
-		if !ok {
-			return d, errors.New("dict key was not a string but should have been")
-		}
-		v, err := decode(r)
-		if v == nil && err == nil {
-			return d, errors.New("last dict key has no associated value")
-		} else if err == nil {
-			d = append(d, P(ks, v))
+func (b *builderOrder) Swap(i, j int) {
+	b.pairs[i], b.pairs[j] = b.pairs[j], b.pairs[i]
+	b.order[i], b.order[j] = b.order[j], b.order[i]
+}
+
+// Dict returns the sorted Dict of every pair added so far and resets the
+// builder. When a key was added more than once the last value wins.
+func (b *DictBuilder) Dict() Dict {
+	sort.Sort((*builderOrder)(b))
+	ret := Dict(b.pairs[:0])
+	for _, p := range b.pairs {
+		if n := len(ret); n > 0 && ret[n-1].Key.Equal(p.Key) {
+			ret[n-1] = p
 		} else {
-			return d, err
+			ret = append(ret, p)
 		}
 	}
+	b.pairs, b.order = nil, b.order[:0]
+	return ret
 }
 
-func decode(r *Reader) (Bencoder, error) {
-	b := mbytes(1)
-	r.Read(b)
-	if r.n > 0 {
-		switch b[0] {
-		case num0, num1, num2, num3, num4, num5, num6, num7, num8, num9:
-			return decodeString(r, b)
-		case intStart:
-			return decodeInt(r)
-		case listStart:
-			return decodeList(r)
-		case dictStart:
-			return decodeDict(r)
-		case end:
-			return nil, nil
-		default:
-			return nil, errors.New("invalid character found " + string(b[0]))
+// Clone returns a deep copy of v that shares no memory with it.
+func Clone(v Bencoder) Bencoder {
+	switch t := v.(type) {
+	case String:
+		return t.Clone()
+	case BigInt:
+		return BigI(t.Raw())
+	case List:
+		l := make(List, len(t))
+		for i, elem := range t {
+			l[i] = Clone(elem)
+		}
+		return l
+	case Dict:
+		d := make(Dict, len(t))
+		for i, p := range t {
+			d[i] = P(p.Key.Clone(), Clone(p.Value))
 		}
-	} else if r.err != nil {
-		return nil, r.err
+		return d
 	}
-	return nil, errors.New("empty reader cannot be decoded")
+	return v
 }
 
-func Decode(r io.Reader) (Bencoder, error) {
-	ret, err := decode(NewReader(r))
+// Functions to handle decoding of types coming over the wire
+
+func decodeFrom(dec *Decoder) (Bencoder, error) {
+	ret, err := dec.Value()
 	if err == io.EOF {
 		return ret, nil
 	}
 	return ret, err
 }
 
+func Decode(r io.Reader) (Bencoder, error) { return decodeFrom(NewDecoder(r)) }
+
 func DecodeFromBytes(bs []byte) (Bencoder, error) {
-	return Decode(bytes.NewBuffer(bs))
+	return decodeFrom(newDecoder(&bytesSource{data: bs}))
+}
+
+// DecodeFromBytesNoCopy is like DecodeFromBytes except that every String in
+// the result aliases bs instead of being copied out of it.
+func DecodeFromBytesNoCopy(bs []byte) (Bencoder, error) {
+	return decodeFrom(NewBytesDecoder(bs))
 }
 
 func DecodeFromString(s string) (Bencoder, error) {
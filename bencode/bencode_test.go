@@ -4,6 +4,7 @@ import (
 	"bytes"
 	_ "embed"
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -204,6 +205,68 @@ func TestBuildDictFromPairs(t *testing.T) {
 	}
 }
 
+func TestDictSetDelete(t *testing.T) {
+	d := D()
+	for _, k := range []string{"cow", "all", "jazz", "bin", "cow"} {
+		d = d.Set(S(k), S(k+"!"))
+	}
+	if d.String() != "d3:all4:all!3:bin4:bin!3:cow4:cow!4:jazz5:jazz!e" {
+		t.Fatal("Set did not keep keys sorted and unique", d.String())
+	}
+	d = d.Set(S("cow"), I(1))
+	if v, err := d.GetInt(S("cow")); err != nil || v != 1 {
+		t.Fatal("Set did not replace existing value", d.String())
+	}
+	d = d.Delete(S("all")).Delete(S("jazz")).Delete(S("missing"))
+	if !equal(d.Keys(), []String{S("bin"), S("cow")}) {
+		t.Fatal("Delete removed the wrong keys", d.String())
+	}
+	d = d.Delete(S("bin")).Delete(S("cow"))
+	if d.Len() != 0 || d.String() != "de" {
+		t.Fatal("dict should be empty", d.String())
+	}
+}
+
+func TestDictMerge(t *testing.T) {
+	a := D(P(S("a"), I(1)), P(S("c"), I(3)), P(S("e"), I(5)))
+	o := D(P(S("b"), I(2)), P(S("c"), S("three")), P(S("f"), I(6)))
+	m := a.Merge(o)
+	if m.String() != "d1:ai1e1:bi2e1:c5:three1:ei5e1:fi6ee" {
+		t.Fatal("merge was incorrect", m.String())
+	}
+	if a.String() != "d1:ai1e1:ci3e1:ei5ee" {
+		t.Fatal("merge modified its receiver", a.String())
+	}
+	if D().Merge(o).String() != o.String() || o.Merge(nil).String() != o.String() {
+		t.Fatal("merge with an empty dict should be a copy")
+	}
+}
+
+func TestDictClone(t *testing.T) {
+	d := D(P(S("a"), L(S("x"))), P(S("b"), D(P(S("c"), S("y")))))
+	c := d.Clone()
+	c.Get(S("a")).(List)[0].(String)[0] = 'z'
+	c = c.Set(S("b"), I(0))
+	if d.String() != "d1:al1:xe1:bd1:c1:yee" {
+		t.Fatal("clone shared memory with original", d.String())
+	}
+}
+
+func TestDictBuilder(t *testing.T) {
+	b := NewDictBuilder(4)
+	b.Add(S("values"), L(S("peer"))).Add(S("id"), S("abc")).Add(S("token"), S("t")).Add(S("id"), S("xyz"))
+	if b.Len() != 4 {
+		t.Fatal("builder should hold every added pair")
+	}
+	d := b.Dict()
+	if d.String() != "d2:id3:xyz5:token1:t6:valuesl4:peeree" {
+		t.Fatal("builder built the wrong dict", d.String())
+	}
+	if b.Len() != 0 || b.Dict().Len() != 0 {
+		t.Fatal("builder should be reset after Dict")
+	}
+}
+
 func TestPrettyDict(t *testing.T) {
 	d := D(
 		P(S("cow"), S("moo")),
@@ -230,16 +293,16 @@ user
 }
 
 type unmarshalStruct struct {
-	A string
-	B int64
+	A string `bencode:"a"`
+	B int64  `bencode:"cow"`
 	D struct {
-		A string
-		B int64
-	}
+		A string `bencode:"a-dict"`
+		B int64  `bencode:"dog"`
+	} `bencode:"dict"`
 	L struct {
 		First  string
 		Second string
-	}
+	} `bencode:"final"`
 }
 
 func TestUnmarshal(t *testing.T) {
@@ -250,12 +313,19 @@ func TestUnmarshal(t *testing.T) {
 			P(S("a-dict"), S("innera")),
 			P(S("dog"), I(100)),
 		)),
+		P(S("extra"), S("ignored")),
 		P(S("final"), L(S("first"), S("second"))),
 	)
 	ump := &unmarshalStruct{}
 	if err := d.Unmarshal(reflect.ValueOf(ump)); err != nil {
 		t.Fatal(err)
 	}
+	if ump.A != "topa" || ump.B != 10 || ump.D.A != "innera" || ump.D.B != 100 {
+		t.Fatal("dict was not unmarshalled into tagged fields correctly", ump)
+	}
+	if ump.L.First != "first" || ump.L.Second != "second" {
+		t.Fatal("list was not unmarshalled into struct correctly", ump)
+	}
 }
 
 var (
@@ -280,6 +350,59 @@ func TestDecodeRealWorldData(t *testing.T) {
 	}
 }
 
+func TestDecodeNoCopy(t *testing.T) {
+	data := []byte("d3:key5:valuee")
+	v, err := DecodeFromBytesNoCopy(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DecodeFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloned := Clone(v)
+	copy(data[8:], "VALUE")
+	if v.(Dict).Get(S("key")).(String).Raw() != "VALUE" {
+		t.Fatal("String did not alias the input buffer")
+	}
+	if c.(Dict).Get(S("key")).(String).Raw() != "value" {
+		t.Fatal("DecodeFromBytes String aliased the input buffer")
+	}
+	if cloned.(Dict).Get(S("key")).(String).Raw() != "value" {
+		t.Fatal("Clone did not detach the value from the input buffer")
+	}
+	s := v.(Dict).Get(S("key")).(String)
+	_ = append(s, 'x')
+	if data[len(data)-1] != 'e' {
+		t.Fatal("appending to an aliased String overwrote the input buffer")
+	}
+}
+
+func BenchmarkBuildDict(b *testing.B) {
+	keys := make([]String, 1000)
+	for i := range keys {
+		keys[i] = S(strconv.Itoa((i * 7919) % len(keys)))
+	}
+	b.ReportAllocs()
+	b.Run("Set", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			d := D()
+			for _, k := range keys {
+				d = d.Set(k, I(0))
+			}
+		}
+	})
+	b.Run("Builder", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			bld := NewDictBuilder(len(keys))
+			for _, k := range keys {
+				bld.Add(k, I(0))
+			}
+			bld.Dict()
+		}
+	})
+}
+
 func BenchmarkRealWorld(b *testing.B) {
 	b.SetParallelism(1)
 	b.ReportAllocs()
@@ -292,6 +415,15 @@ func BenchmarkRealWorld(b *testing.B) {
 		}
 		b.StopTimer()
 	})
+	b.Run("UnmarshalNoCopy", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			torrent, err = DecodeFromBytesNoCopy(realWorldData)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+	})
 	b.Run("Marshal", func(b *testing.B) {
 		for n := 0; n < b.N; n++ {
 			buffer = bytes.NewBuffer(mbytes(0))
@@ -301,6 +433,16 @@ func BenchmarkRealWorld(b *testing.B) {
 		}
 		b.StopTimer()
 	})
+	b.Run("Append", func(b *testing.B) {
+		buf := mbytes(0)
+		for n := 0; n < b.N; n++ {
+			buf = torrent.(Bencoder).AppendBencode(buf[:0])
+		}
+		b.StopTimer()
+		if !bytes.Equal(realWorldData, buf) {
+			b.Fatal("appended bytes were not equal to the input")
+		}
+	})
 	b.StopTimer()
 	if string(realWorldData) != buffer.String() {
 		b.Fatal("strings should have been equal but were not")
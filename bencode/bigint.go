@@ -0,0 +1,95 @@
+package bencode
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+)
+
+// BigInt is an integer too large to fit in an Int. A Decoder only produces
+// BigInts when UseBigInts is on, otherwise such integers are rejected with
+// ErrIntOverflow.
+type BigInt struct {
+	v *big.Int
+}
+
+// ErrIntOverflow is returned for integers that do not fit in an int64.
+var ErrIntOverflow = errors.New("bencode: integer overflows int64")
+
+var bigIntType = reflect.TypeOf(big.Int{})
+
+// BigI returns x as a BigInt. x is not copied so it must not be changed
+// afterwards.
+func BigI(x *big.Int) BigInt { return BigInt{x} }
+
+func (b BigInt) int() *big.Int {
+	if b.v == nil {
+		return new(big.Int)
+	}
+	return b.v
+}
+
+// Raw returns a copy of the value of b.
+func (b BigInt) Raw() *big.Int { return new(big.Int).Set(b.int()) }
+
+func (b BigInt) Bencode(w *Writer) error { return w.Write(b.AppendBencode(nil)).err }
+
+func (b BigInt) AppendBencode(dst []byte) []byte {
+	dst = append(dst, intStart)
+	dst = b.int().Append(dst, 10)
+	return append(dst, end)
+}
+
+func (b BigInt) Unmarshal(dst reflect.Value) error {
+	e, err := settable(dst, "BigInt")
+	if err != nil {
+		return err
+	}
+	if ok, err := unmarshalWith(e, b); ok {
+		return err
+	}
+	x := b.int()
+	switch {
+	case e.Type() == reflect.TypeOf(b):
+		e.Set(reflect.ValueOf(b))
+	case e.Type() == bigIntType:
+		e.Addr().Interface().(*big.Int).Set(x)
+	case setBencoder(e, b):
+	case x.IsInt64():
+		return Int(x.Int64()).Unmarshal(dst)
+	default:
+		switch e.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if !x.IsUint64() || e.OverflowUint(x.Uint64()) {
+				return errors.New("(BigInt) value overflows field")
+			}
+			e.SetUint(x.Uint64())
+		case reflect.Bool:
+			e.SetBool(x.Sign() != 0)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return errors.New("(BigInt) value overflows field")
+		default:
+			return errors.New("(BigInt) invalid type for field")
+		}
+	}
+	return nil
+}
+
+func (b BigInt) Pretty(ind, _ string) string { return ind + b.int().String() + "\n" }
+
+func (b BigInt) Bytes() []byte { return b.AppendBencode(nil) }
+
+func (b BigInt) String() string { return string(b.Bytes()) }
+
+// UseBigInts makes the decoder return a BigInt for every integer that does not
+// fit in an Int instead of failing with ErrIntOverflow.
+func (d *Decoder) UseBigInts(on bool) { d.bigInts = on }
+
+// bigInt parses raw, which parseInt found to overflow, as a BigInt.
+func (d *Decoder) bigInt(raw []byte, off int64) (BigInt, error) {
+	x, ok := new(big.Int).SetString(string(raw), 10)
+	if !ok {
+		return BigInt{}, syntaxError(off, "invalid character found when parsing int")
+	}
+	return BigInt{x}, nil
+}
@@ -0,0 +1,91 @@
+package bencode
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIntOverflow(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"i9223372036854775807e":  math.MaxInt64,
+		"i-9223372036854775808e": math.MinInt64,
+	} {
+		v, err := DecodeFromString(input)
+		if err != nil || v.(Int).Raw() != expected {
+			t.Fatal("could not decode", input, v, err)
+		}
+	}
+	for _, input := range []string{
+		"i9223372036854775808e",
+		"i-9223372036854775809e",
+		"i123456789012345678901234567890e",
+		"99999999999999999999:x",
+	} {
+		if _, err := DecodeFromString(input); !errors.Is(err, ErrIntOverflow) {
+			t.Fatal("expected overflow error for", input, "but got", err)
+		}
+	}
+}
+
+func TestBigInt(t *testing.T) {
+	input := "li1ei-123456789012345678901234567890ei18446744073709551615ee"
+	dec := NewDecoder(strings.NewReader(input))
+	dec.UseBigInts(true)
+	v, err := dec.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := v.(List)
+	if _, ok := l[0].(Int); !ok {
+		t.Fatal("integers that fit in an int64 should still be Ints", l[0])
+	}
+	if b, ok := l[1].(BigInt); !ok || b.Raw().String() != "-123456789012345678901234567890" {
+		t.Fatal("big integer was not decoded as a BigInt", l[1])
+	}
+	if v.String() != input {
+		t.Fatal("BigInt did not round trip", v.String())
+	}
+	var out struct {
+		Small big.Int  `bencode:"small"`
+		Big   *big.Int `bencode:"big"`
+		Max   uint64   `bencode:"max"`
+		Neg   uint64   `bencode:"neg"`
+	}
+	dec = NewDecoder(strings.NewReader("d3:bigi123456789012345678901234567890e3:maxi18446744073709551615e5:smalli1ee"))
+	dec.UseBigInts(true)
+	if err := dec.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Small.Int64() != 1 || out.Big.String() != "123456789012345678901234567890" || out.Max != math.MaxUint64 {
+		t.Fatal("BigInts were not unmarshalled correctly", out)
+	}
+	if err := D(P(S("neg"), l[1])).Unmarshal(reflect.ValueOf(&out)); err == nil {
+		t.Fatal("should not unmarshal a negative BigInt into a uint64")
+	}
+	data, err := Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d3:bigi123456789012345678901234567890e3:maxi18446744073709551615e3:negi0e5:smalli1ee" {
+		t.Fatal("big.Int fields were not marshalled correctly", string(data))
+	}
+}
+
+func TestBigIntJSON(t *testing.T) {
+	v := L(I(1), BigI(new(big.Int).Lsh(big.NewInt(1), 100)))
+	data, err := ToJSON(v, JSONOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "[1,1267650600228229401496703205376]" {
+		t.Fatal("BigInt was not converted to JSON", string(data))
+	}
+	back, err := FromJSON(data)
+	if err != nil || back.String() != v.String() {
+		t.Fatal("BigInt did not survive a JSON round trip", back, err)
+	}
+}
@@ -0,0 +1,489 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+)
+
+type (
+	// Delim is one of the container delimiters: 'l', 'd' or 'e'.
+	Delim byte
+	// Token holds a String, an Int or a Delim, or a BigInt when UseBigInts is
+	// on.
+	Token interface{}
+	// Decoder reads bencoded values and tokens from a stream. Several
+	// concatenated values can be read from one Decoder.
+	Decoder struct {
+		src     source
+		stack   []frame
+		scratch []byte
+		spans   bool
+		span    Span
+		mode    Mode
+		warns   []*SyntaxError
+		opts    DecoderOptions
+		count   int
+		bigInts bool
+	}
+	frame struct {
+		kind  Delim
+		elems int
+		key   String
+	}
+	byteReader interface {
+		io.Reader
+		io.ByteScanner
+	}
+	source interface {
+		io.ByteScanner
+		next(n int64) ([]byte, error)
+		discard(n int64) error
+		offset() int64
+		mark()
+		captured() []byte
+	}
+	readerSource struct {
+		r         byteReader
+		off       int64
+		recording bool
+		rec       []byte
+	}
+	bytesSource struct {
+		data  []byte
+		off   int
+		alias bool
+		start int
+	}
+)
+
+func (d Delim) String() string { return string(d) }
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return newDecoder(&readerSource{r: br})
+}
+
+// NewBytesDecoder returns a Decoder that reads from data without copying it.
+// Every String it produces aliases data, so data must not be modified while
+// the decoded values are in use; use Clone to detach a value from data.
+func NewBytesDecoder(data []byte) *Decoder {
+	return newDecoder(&bytesSource{data: data, alias: true})
+}
+
+func newDecoder(src source) *Decoder {
+	return &Decoder{
+		src:     src,
+		stack:   make([]frame, 0),
+		scratch: make([]byte, 0, 20),
+		opts:    DefaultDecoderOptions,
+	}
+}
+
+func (s *readerSource) ReadByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == nil {
+		s.off++
+		if s.recording {
+			s.rec = append(s.rec, c)
+		}
+	}
+	return c, err
+}
+
+func (s *readerSource) UnreadByte() error {
+	err := s.r.UnreadByte()
+	if err == nil {
+		s.off--
+		if s.recording && len(s.rec) > 0 {
+			s.rec = s.rec[:len(s.rec)-1]
+		}
+	}
+	return err
+}
+
+func (s *readerSource) next(n int64) ([]byte, error) {
+	// grow the buffer as data arrives rather than trusting n up front
+	buf := bytes.NewBuffer(make([]byte, 0, minInt64(n, readChunk)))
+	read, err := io.CopyN(buf, s.r, n)
+	s.off += read
+	if s.recording {
+		s.rec = append(s.rec, buf.Bytes()...)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+func (s *readerSource) discard(n int64) error {
+	if s.recording {
+		_, err := s.next(n)
+		return err
+	}
+	read, err := io.CopyN(io.Discard, s.r, n)
+	s.off += read
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (s *readerSource) offset() int64 { return s.off }
+
+func (s *readerSource) mark() { s.recording, s.rec = true, make([]byte, 0) }
+
+func (s *readerSource) captured() []byte {
+	s.recording = false
+	return s.rec
+}
+
+func (s *bytesSource) ReadByte() (byte, error) {
+	if s.off >= len(s.data) {
+		return 0, io.EOF
+	}
+	c := s.data[s.off]
+	s.off++
+	return c, nil
+}
+
+func (s *bytesSource) UnreadByte() error {
+	if s.off <= 0 {
+		return errors.New("cannot unread before start of data")
+	}
+	s.off--
+	return nil
+}
+
+func (s *bytesSource) next(n int64) ([]byte, error) {
+	if n > int64(len(s.data)-s.off) {
+		s.off = len(s.data)
+		return nil, io.ErrUnexpectedEOF
+	}
+	start, stop := s.off, s.off+int(n)
+	s.off = stop
+	if s.alias {
+		return s.data[start:stop:stop], nil
+	}
+	return append(make([]byte, 0, n), s.data[start:stop]...), nil
+}
+
+func (s *bytesSource) discard(n int64) error {
+	_, err := s.next(n)
+	return err
+}
+
+func (s *bytesSource) offset() int64 { return int64(s.off) }
+
+func (s *bytesSource) mark() { s.start = s.off }
+
+func (s *bytesSource) captured() []byte {
+	if s.alias {
+		return s.data[s.start:s.off:s.off]
+	}
+	return append(make([]byte, 0, s.off-s.start), s.data[s.start:s.off]...)
+}
+
+// Offset returns the number of bytes consumed from the input so far.
+func (d *Decoder) Offset() int64 { return d.src.offset() }
+
+// Depth returns the number of containers the decoder is currently inside.
+func (d *Decoder) Depth() int { return len(d.stack) }
+
+func (d *Decoder) top() *frame {
+	if len(d.stack) == 0 {
+		return nil
+	}
+	return &d.stack[len(d.stack)-1]
+}
+
+func (d *Decoder) eof(err error) error {
+	if err == io.EOF && len(d.stack) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readUntil collects bytes up to, but not including, b into the scratch space.
+func (d *Decoder) readUntil(b byte, app []byte) ([]byte, error) {
+	for {
+		c, err := d.src.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return app, io.ErrUnexpectedEOF
+			}
+			return app, err
+		}
+		if err := d.checkTotal(d.Offset()); err != nil {
+			return app, err
+		}
+		if c == b {
+			return app, nil
+		}
+		app = append(app, c)
+	}
+}
+
+func (d *Decoder) readLength(first byte, off int64) (int64, error) {
+	raw, err := d.readUntil(stringSep, append(d.scratch[:0], first))
+	d.scratch = raw[:0]
+	if err != nil {
+		return 0, err
+	}
+	strLen, err := d.number(raw, off, "string length")
+	if err != nil {
+		return 0, err
+	}
+	if strLen < 0 {
+		return 0, syntaxError(off, "string length must be positive or 0")
+	}
+	return strLen, d.checkString(strLen, off)
+}
+
+func (d *Decoder) readString(first byte, off int64) (String, error) {
+	strLen, err := d.readLength(first, off)
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.src.next(strLen)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return String(s), err
+}
+
+func (d *Decoder) readInt(off int64) (Bencoder, error) {
+	raw, err := d.readUntil(end, d.scratch[:0])
+	d.scratch = raw[:0]
+	if err != nil {
+		return nil, err
+	}
+	i, err := d.number(raw, off, "integer")
+	if d.bigInts && errors.Is(err, ErrIntOverflow) {
+		return d.bigInt(raw, off)
+	}
+	return Int(i), err
+}
+
+// inKey reports whether the next token is a dict key.
+func (d *Decoder) inKey() bool {
+	top := d.top()
+	return top != nil && top.kind == dictStart && top.elems%2 == 0
+}
+
+// begin checks that a value starting with c may appear at this point.
+func (d *Decoder) begin(c byte, off int64) error {
+	if top := d.top(); top != nil && top.kind == dictStart {
+		if top.elems%2 == 0 && c != end && (c < num0 || c > num9) {
+			return syntaxError(off, "dict key was not a string but should have been")
+		}
+		if top.elems%2 == 1 && c == end {
+			return syntaxError(off, "last dict key has no associated value")
+		}
+	}
+	return nil
+}
+
+// finish records that a complete value has been read.
+func (d *Decoder) finish() {
+	if top := d.top(); top != nil {
+		top.elems++
+	}
+}
+
+func (d *Decoder) token(skip bool) (Token, error) {
+	off := d.Offset()
+	c, err := d.src.ReadByte()
+	if err != nil {
+		return nil, d.eof(err)
+	}
+	if err := d.begin(c, off); err != nil {
+		return nil, err
+	}
+	if err := d.checkElement(c, off); err != nil {
+		return nil, err
+	}
+	switch c {
+	case num0, num1, num2, num3, num4, num5, num6, num7, num8, num9:
+		isKey := d.mode != ModeDefault && d.inKey()
+		if skip && !isKey {
+			strLen, err := d.readLength(c, off)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.src.discard(strLen); err != nil {
+				return nil, d.eof(err)
+			}
+			d.finish()
+			return String(nil), nil
+		}
+		s, err := d.readString(c, off)
+		if err != nil {
+			return nil, err
+		}
+		if isKey {
+			if err := d.checkKey(s, off); err != nil {
+				return nil, err
+			}
+		}
+		d.finish()
+		return s, nil
+	case intStart:
+		i, err := d.readInt(off)
+		if err != nil {
+			return nil, err
+		}
+		d.finish()
+		return i, nil
+	case listStart, dictStart:
+		if err := d.checkDepth(off); err != nil {
+			return nil, err
+		}
+		d.stack = append(d.stack, frame{Delim(c), 0, nil})
+		return Delim(c), nil
+	case end:
+		if len(d.stack) == 0 {
+			return nil, syntaxError(off, "end found outside of list or dict")
+		}
+		d.stack = d.stack[:len(d.stack)-1]
+		d.finish()
+		return Delim(c), nil
+	}
+	return nil, syntaxError(off, "invalid character found "+string(c))
+}
+
+// Token returns the next String, Int, BigInt or Delim in the input stream. At the end
+// of the input Token returns nil and io.EOF.
+func (d *Decoder) Token() (Token, error) { return d.token(false) }
+
+// More reports whether there is another element in the current list or dict,
+// or, outside of any container, whether there is another value in the stream.
+func (d *Decoder) More() bool {
+	c, err := d.src.ReadByte()
+	if err != nil {
+		return false
+	}
+	d.src.UnreadByte()
+	return c != end
+}
+
+// Skip discards the next value, including every value nested inside of it,
+// without building it.
+func (d *Decoder) Skip() error {
+	depth, off := len(d.stack), d.Offset()
+	t, err := d.token(true)
+	if err != nil {
+		return err
+	}
+	if t == Delim(end) {
+		return syntaxError(off, "no value to skip at end of list or dict")
+	}
+	for len(d.stack) > depth {
+		if _, err := d.token(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Value reads the next complete value from the input stream.
+func (d *Decoder) Value() (Bencoder, error) {
+	start := d.Offset()
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	if !d.spans {
+		return d.value(t, nil)
+	}
+	d.span = Span{Start: start}
+	return d.value(t, &d.span)
+}
+
+// Decode reads the next value from the input stream and stores it in v.
+func (d *Decoder) Decode(v interface{}) error {
+	val, err := d.Value()
+	if err != nil {
+		return err
+	}
+	dst := reflect.ValueOf(v)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return errors.New("can only unmarshal to non nil ptr")
+	}
+	return val.Unmarshal(dst)
+}
+
+// value finishes reading the value that starts with t. If span is not nil
+// the location of the value and all of its elements is recorded in it.
+func (d *Decoder) value(t Token, span *Span) (ret Bencoder, err error) {
+	off := d.Offset() - 1
+	if span != nil {
+		defer func() { span.End = d.Offset() }()
+	}
+	switch v := t.(type) {
+	case String:
+		return v, nil
+	case Int:
+		return v, nil
+	case BigInt:
+		return v, nil
+	case Delim:
+		switch v {
+		case listStart:
+			return d.list(span)
+		case dictStart:
+			return d.dict(span)
+		}
+	}
+	return nil, syntaxError(off, "end found where a value was expected")
+}
+
+// elem reads the next element of a list or dict, reporting false at the end.
+func (d *Decoder) elem(span *Span) (Bencoder, bool, error) {
+	start := d.Offset()
+	t, err := d.Token()
+	if err != nil || t == Delim(end) {
+		return nil, false, err
+	}
+	if span == nil {
+		v, err := d.value(t, nil)
+		return v, err == nil, err
+	}
+	span.Elems = append(span.Elems, Span{Start: start})
+	v, err := d.value(t, &span.Elems[len(span.Elems)-1])
+	return v, err == nil, err
+}
+
+func (d *Decoder) list(span *Span) (List, error) {
+	l := make(List, 0)
+	for {
+		elem, ok, err := d.elem(span)
+		if !ok {
+			return l, err
+		}
+		l = append(l, elem)
+	}
+}
+
+func (d *Decoder) dict(span *Span) (Dict, error) {
+	dict := make(Dict, 0)
+	for {
+		k, err := d.Token()
+		if err != nil {
+			return dict, err
+		}
+		if k == Delim(end) {
+			return dict, nil
+		}
+		v, _, err := d.elem(span)
+		if err != nil {
+			return dict, err
+		}
+		dict = append(dict, P(k.(String), v))
+	}
+}
@@ -0,0 +1,123 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderTokens(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d4:spaml1:ai-3eee"))
+	expected := []Token{Delim('d'), S("spam"), Delim('l'), S("a"), I(-3), Delim('e'), Delim('e')}
+	for i, exp := range expected {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tok, exp) {
+			t.Fatal("unexpected token at index", i, tok, exp)
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		t.Fatal("expected io.EOF at end of input but got", err)
+	}
+}
+
+func TestDecoderConcatenated(t *testing.T) {
+	// io.MultiReader does not implement io.ByteScanner so it gets buffered
+	dec := NewDecoder(io.MultiReader(strings.NewReader("4:spami4e"), strings.NewReader("le")))
+	values := make([]string, 0)
+	for dec.More() {
+		v, err := dec.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v.String())
+	}
+	if strings.Join(values, ",") != "4:spam,i4e,le" {
+		t.Fatal("concatenated values were not decoded correctly", values)
+	}
+	if dec.Offset() != 11 {
+		t.Fatal("decoder reported wrong offset", dec.Offset())
+	}
+}
+
+func TestDecoderMoreAndSkip(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d1:ald1:xi1eee1:bi2e1:c3:fooe"))
+	if tok, err := dec.Token(); err != nil || tok != Delim('d') {
+		t.Fatal("expected dict start", tok, err)
+	}
+	keys := make([]string, 0)
+	for dec.More() {
+		k, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k.(String).Raw())
+		if k.(String).Raw() == "b" {
+			v := Int(0)
+			if err := dec.Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			if v != 2 {
+				t.Fatal("decoded wrong value for key b", v)
+			}
+		} else if err := dec.Skip(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(keys, "") != "abc" {
+		t.Fatal("walked the wrong keys", keys)
+	}
+	if dec.Depth() != 1 {
+		t.Fatal("decoder reported wrong depth", dec.Depth())
+	}
+	if err := dec.Skip(); err == nil {
+		t.Fatal("skip at end of dict should fail")
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	for _, input := range []string{"di1e1:ae", "d1:ae", "l4:spa", "e", "x", "5:abc", "i12", "ie", "i-e"} {
+		if _, err := NewDecoder(strings.NewReader(input)).Value(); err == nil || err == io.EOF {
+			t.Fatal("invalid input decoded without error", input, err)
+		}
+	}
+}
+
+func TestDecoderRealWorldData(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(realWorldData))
+	if _, err := dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	var announce string
+	var info struct {
+		Name        string `bencode:"name"`
+		PieceLength int64  `bencode:"piece length"`
+	}
+	for dec.More() {
+		k, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch k.(String).Raw() {
+		case "announce":
+			err = dec.Decode(&announce)
+		case "info":
+			err = dec.Decode(&info)
+		default:
+			err = dec.Skip()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if announce != "https://torrent.ubuntu.com/announce" {
+		t.Fatal("unexpected announce url", announce)
+	}
+	if info.Name != "ubuntu-21.04-desktop-amd64.iso" || info.PieceLength != 262144 {
+		t.Fatal("unexpected info dict", info)
+	}
+}
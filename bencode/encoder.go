@@ -0,0 +1,49 @@
+package bencode
+
+import (
+	"io"
+	"sync"
+)
+
+// Encoder writes bencoded values to an output stream. It reuses a single
+// buffer for every value so encoding does not allocate once the buffer has
+// grown to fit the largest value written.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+const pooledBufferSize = 1 << 11
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, pooledBufferSize)
+		return &buf
+	},
+}
+
+func NewEncoder(w io.Writer) *Encoder { return &Encoder{w: w} }
+
+// Encode writes the bencoding of v to the stream.
+func (e *Encoder) Encode(v Bencoder) error {
+	e.buf = v.AppendBencode(e.buf[:0])
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// AcquireBuffer returns an empty buffer from a shared pool. Pass it to
+// ReleaseBuffer once its contents are no longer needed.
+func AcquireBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// ReleaseBuffer returns buf to the pool used by AcquireBuffer. Buffers that
+// grew very large are dropped so the pool does not pin their memory.
+func ReleaseBuffer(buf *[]byte) {
+	if cap(*buf) > 1<<16 {
+		return
+	}
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,36 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	values := []Bencoder{
+		S("spam"),
+		I(-42),
+		L(S("a"), I(1), L()),
+		D(P(S("b"), D(P(S("c"), S("")))), P(S("a"), L(I(0)))),
+		RawMessage("i7e"),
+	}
+	expected := ""
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if string(v.AppendBencode([]byte("x"))) != "x"+v.String() {
+			t.Fatal("AppendBencode did not append to dst for", v.String())
+		}
+		expected += v.String()
+	}
+	if buf.String() != expected {
+		t.Fatal("encoder wrote", buf.String(), "expected", expected)
+	}
+	enc = NewEncoder(io.Discard)
+	if allocs := testing.AllocsPerRun(100, func() { enc.Encode(values[3]) }); allocs != 0 {
+		t.Fatal("encoder allocated", allocs, "times per value")
+	}
+}
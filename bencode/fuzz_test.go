@@ -0,0 +1,85 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// fuzzSeeds are the inputs used by the other tests in this package, including
+// ones that are known to be invalid.
+var fuzzSeeds = []string{
+	"4:spam", "0:", "i42e", "i-42e", "i0e", "i-0e", "i03e", "ie", "i-e", "4:spamx",
+	"l4:spam4:eggse", "le", "lli1eee", "d3:cow3:moo4:spam4:eggse", "de",
+	"d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee", "d1:ai1ei2ei3ee", "l03:abce",
+	"d1:bi03e1:ai-0e1:al04:spamee3:foo", "d1:a999999:x1:y1:qe", "x", "",
+	"d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe",
+}
+
+func addFuzzSeeds(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Add(realWorldData)
+}
+
+func FuzzDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := DecodeFromBytes(data)
+		nc, ncErr := DecodeFromBytesNoCopy(data)
+		r, rErr := Decode(bytes.NewReader(data))
+		if (err == nil) != (ncErr == nil) || (err == nil) != (rErr == nil) {
+			t.Fatal("decoders disagreed on", data, err, ncErr, rErr)
+		}
+		if err != nil || v == nil {
+			return
+		}
+		enc := v.Bytes()
+		if !bytes.Equal(enc, nc.Bytes()) || !bytes.Equal(enc, r.Bytes()) {
+			t.Fatal("decoders returned different values for", data)
+		}
+		again, err := DecodeFromBytes(enc)
+		if err != nil {
+			t.Fatal("could not decode re-encoded value", enc, err)
+		}
+		if !bytes.Equal(enc, again.Bytes()) {
+			t.Fatal("value did not survive a round trip", enc, again.Bytes())
+		}
+	})
+}
+
+type fuzzTarget struct {
+	S      string             `bencode:"s"`
+	B      []byte             `bencode:"b"`
+	I      int64              `bencode:"i"`
+	U8     uint8              `bencode:"u8"`
+	Flag   bool               `bencode:"flag"`
+	Hash   [4]byte            `bencode:"hash"`
+	List   []string           `bencode:"list"`
+	Pair   [2]int             `bencode:"pair"`
+	Map    map[string]int64   `bencode:"map"`
+	Any    Bencoder           `bencode:"any"`
+	Raw    RawMessage         `bencode:"raw"`
+	Nested *fuzzTarget        `bencode:"nested"`
+	Tuple  struct{ A, B int } `bencode:"tuple"`
+}
+
+func FuzzDictUnmarshal(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Add([]byte("d1:s4:spam1:b3:abc1:ii-3e2:u8i255e4:flagi1e4:hash4:abcd4:listl1:ae4:pairli1ei2ee3:mapd1:ai1ee3:anyle3:rawi1e6:nestedd1:sle5:tupleli1ei2eee"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := DecodeFromBytes(data)
+		if err != nil {
+			return
+		}
+		d, ok := v.(Dict)
+		if !ok {
+			return
+		}
+		var target fuzzTarget
+		_ = d.Unmarshal(reflect.ValueOf(&target))
+		var m map[string]interface{}
+		_ = Unmarshal(data, &m)
+	})
+}
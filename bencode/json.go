@@ -0,0 +1,277 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+)
+
+type (
+	// BinaryEncoding is how Strings that are not valid UTF-8 are written as JSON.
+	BinaryEncoding int
+	// JSONOptions control the output of ToJSON.
+	JSONOptions struct {
+		Binary BinaryEncoding
+		// Indent, if set, pretty prints the output with this indentation.
+		Indent string
+	}
+)
+
+const (
+	// BinaryHex writes binary Strings as {"$hex": "..."}.
+	BinaryHex BinaryEncoding = iota
+	// BinaryBase64 writes binary Strings as {"$base64": "..."}.
+	BinaryBase64
+)
+
+// Tags of the JSON objects that stand in for values with no JSON equivalent.
+// A Dict whose keys are not all valid UTF-8, are not sorted or are repeated,
+// or whose only key is one of these tags, is written as
+// {"$dict": [[key, value], ...]}.
+const (
+	jsonHex    = "$hex"
+	jsonBase64 = "$base64"
+	jsonDict   = "$dict"
+)
+
+// ToJSON converts v to JSON. Strings become JSON strings when they are valid
+// UTF-8 and tagged objects otherwise, so that FromJSON can always recover v.
+func ToJSON(v Bencoder, opts JSONOptions) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := writeJSON(buf, v, opts); err != nil {
+		return nil, err
+	}
+	if opts.Indent == "" {
+		return buf.Bytes(), nil
+	}
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, buf.Bytes(), "", opts.Indent); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func isJSONTag(k String) bool {
+	switch k.Raw() {
+	case jsonHex, jsonBase64, jsonDict:
+		return true
+	}
+	return false
+}
+
+func writeJSONString(buf *bytes.Buffer, s String, opts JSONOptions) error {
+	if utf8.Valid(s) {
+		data, err := json.Marshal(s.Raw())
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	}
+	if opts.Binary == BinaryBase64 {
+		buf.WriteString(`{"` + jsonBase64 + `":"` + base64.StdEncoding.EncodeToString(s) + `"}`)
+	} else {
+		buf.WriteString(`{"` + jsonHex + `":"` + hex.EncodeToString(s) + `"}`)
+	}
+	return nil
+}
+
+func writeJSON(buf *bytes.Buffer, v Bencoder, opts JSONOptions) error {
+	switch t := v.(type) {
+	case String:
+		return writeJSONString(buf, t, opts)
+	case Int:
+		buf.WriteString(strconv.FormatInt(t.Raw(), 10))
+	case BigInt:
+		buf.WriteString(t.int().String())
+	case List:
+		buf.WriteByte('[')
+		for i, elem := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, elem, opts); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case Dict:
+		// a JSON object is read back as a sorted Dict without duplicate keys,
+		// so any other Dict has to be written as pairs to survive
+		asPairs := len(t) == 1 && isJSONTag(t[0].Key)
+		for i, p := range t {
+			asPairs = asPairs || !utf8.Valid(p.Key) || i > 0 && !t[i-1].Key.Less(p.Key)
+		}
+		if asPairs {
+			buf.WriteString(`{"` + jsonDict + `":[`)
+		} else {
+			buf.WriteByte('{')
+		}
+		for i, p := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if asPairs {
+				buf.WriteByte('[')
+			}
+			if err := writeJSONString(buf, p.Key, opts); err != nil {
+				return err
+			}
+			if asPairs {
+				buf.WriteByte(',')
+			} else {
+				buf.WriteByte(':')
+			}
+			if err := writeJSON(buf, p.Value, opts); err != nil {
+				return err
+			}
+			if asPairs {
+				buf.WriteByte(']')
+			}
+		}
+		if asPairs {
+			buf.WriteString("]}")
+		} else {
+			buf.WriteByte('}')
+		}
+	case nil:
+		return errors.New("cannot convert nil to JSON")
+	default:
+		// other Bencoders, such as RawMessage, are converted via their bencoding
+		basic, err := RawMessage(v.Bytes()).decode()
+		if err != nil {
+			return err
+		}
+		return writeJSON(buf, basic, opts)
+	}
+	return nil
+}
+
+// FromJSON converts JSON produced by ToJSON, or written by hand, back into a
+// Bencoder. JSON numbers must be integers and true, false and null have no
+// bencode equivalent so they are rejected.
+func FromJSON(data []byte) (Bencoder, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := readJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+func readJSON(dec *json.Decoder) (Bencoder, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	return jsonValue(dec, t)
+}
+
+func jsonValue(dec *json.Decoder, t json.Token) (Bencoder, error) {
+	switch v := t.(type) {
+	case string:
+		return S(v), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return I(i), nil
+		}
+		if x, ok := new(big.Int).SetString(v.String(), 10); ok {
+			return BigI(x), nil
+		}
+		return nil, errors.New("JSON number is not a valid Int: " + v.String())
+	case json.Delim:
+		switch v {
+		case '[':
+			l := make(List, 0)
+			for dec.More() {
+				elem, err := readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				l = append(l, elem)
+			}
+			_, err := dec.Token()
+			return l, err
+		case '{':
+			return jsonObject(dec)
+		}
+	}
+	return nil, errors.New("JSON value has no bencode equivalent")
+}
+
+// jsonObject reads the rest of a JSON object. Plain objects become sorted
+// Dicts, only a $dict keeps its pairs in the order they were written.
+func jsonObject(dec *json.Decoder) (Bencoder, error) {
+	b, seen := NewDictBuilder(0), make(map[string]bool)
+	for dec.More() {
+		kt, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		k := kt.(string)
+		if seen[k] {
+			return nil, errors.New("JSON object has duplicate key: " + k)
+		}
+		seen[k] = true
+		v, err := readJSON(dec)
+		if err != nil {
+			return nil, err
+		}
+		b.Add(S(k), v)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	d := b.Dict()
+	if len(d) != 1 || !isJSONTag(d[0].Key) {
+		return d, nil
+	}
+	return jsonTagged(d[0])
+}
+
+func jsonTagged(p Pair) (Bencoder, error) {
+	if p.Key.Raw() == jsonDict {
+		pairs, ok := p.Value.(List)
+		if !ok {
+			return nil, errors.New(jsonDict + " must hold a list of pairs")
+		}
+		d := make(Dict, 0, len(pairs))
+		for _, pair := range pairs {
+			kv, ok := pair.(List)
+			if !ok || kv.Len() != 2 {
+				return nil, errors.New(jsonDict + " must hold a list of pairs")
+			}
+			k, ok := kv[0].(String)
+			if !ok {
+				return nil, errors.New(jsonDict + " keys must be strings")
+			}
+			d = append(d, P(k, kv[1]))
+		}
+		return d, nil
+	}
+	s, ok := p.Value.(String)
+	if !ok {
+		return nil, errors.New(p.Key.Raw() + " must hold a string")
+	}
+	var data []byte
+	var err error
+	if p.Key.Raw() == jsonHex {
+		data, err = hex.DecodeString(s.Raw())
+	} else {
+		data, err = base64.StdEncoding.DecodeString(s.Raw())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return String(data), nil
+}
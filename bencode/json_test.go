@@ -0,0 +1,100 @@
+package bencode
+
+import (
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	d := D(
+		P(S("id"), String([]byte{0xff, 0x00, 0x10})),
+		P(S("n"), I(-12)),
+		P(S("q"), S("find_node")),
+		P(S("l"), L(S("a"), D())),
+	)
+	data, err := ToJSON(d, JSONOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"id":{"$hex":"ff0010"},"l":["a",{}],"n":-12,"q":"find_node"}` {
+		t.Fatal("unexpected JSON output", string(data))
+	}
+	data, err = ToJSON(d.Get(S("id")), JSONOptions{Binary: BinaryBase64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"$base64":"/wAQ"}` {
+		t.Fatal("unexpected base64 JSON output", string(data))
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, v := range []Bencoder{
+		D(P(String([]byte{0xfe}), I(1)), P(S("a"), I(2))),
+		D(P(S("$hex"), S("00"))),
+		D(P(S("$dict"), L())),
+		L(S("$hex"), String([]byte{0x80}), I(0), L()),
+		S("plain text é"),
+		Dict{P(S("b"), I(1)), P(S("a"), I(2))},
+		Dict{P(S("a"), I(1)), P(S("a"), I(2))},
+	} {
+		for _, opts := range []JSONOptions{{}, {BinaryBase64, "  "}} {
+			data, err := ToJSON(v, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, err := FromJSON(data)
+			if err != nil {
+				t.Fatal(err, string(data))
+			}
+			if back.String() != v.String() {
+				t.Fatal("value did not survive JSON round trip", v.String(), string(data), back.String())
+			}
+		}
+	}
+}
+
+func TestJSONRealWorldData(t *testing.T) {
+	v, err := DecodeFromBytes(realWorldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ToJSON(v, JSONOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := FromJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(back.Bytes()) != string(realWorldData) {
+		t.Fatal("torrent did not survive JSON round trip")
+	}
+}
+
+func TestFromJSONSortsKeys(t *testing.T) {
+	v, err := FromJSON([]byte(`{"b":1,"a":{"d":2,"c":3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "d1:ad1:ci3e1:di2ee1:bi1ee" {
+		t.Fatal("JSON object keys were not sorted", v.String())
+	}
+	if d := v.(Dict); d.Get(S("a")) == nil || d.Get(S("b")) == nil {
+		t.Fatal("keys of a JSON object could not be found")
+	}
+	v, err = FromJSON([]byte(`{"$dict":[["b",1],["a",2]]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "d1:bi1e1:ai2ee" {
+		t.Fatal("$dict did not keep its pairs in order", v.String())
+	}
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	for _, input := range []string{"1.5", "true", "null", `{"$hex":"zz"}`, `{"$dict":[["a"]]}`, "[1] 2", `{"a":1,"a":2}`} {
+		if _, err := FromJSON([]byte(input)); err == nil {
+			t.Fatal("invalid JSON converted without error", input)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+type (
+	// DecoderOptions bounds the resources a Decoder may use on untrusted
+	// input. A zero value for any field means that there is no limit.
+	DecoderOptions struct {
+		// MaxDepth is the deepest that lists and dicts may be nested.
+		MaxDepth int
+		// MaxStringLen is the longest that a single String may be.
+		MaxStringLen int64
+		// MaxTotalBytes is the most input that the Decoder may consume.
+		MaxTotalBytes int64
+		// MaxElements is the most values, including dict keys, that the
+		// Decoder may produce.
+		MaxElements int
+	}
+)
+
+const (
+	readChunk = 1 << 16
+)
+
+var (
+	ErrMaxDepth      = errors.New("bencode: maximum nesting depth exceeded")
+	ErrMaxStringLen  = errors.New("bencode: maximum string length exceeded")
+	ErrMaxTotalBytes = errors.New("bencode: maximum input size exceeded")
+	ErrMaxElements   = errors.New("bencode: maximum number of elements exceeded")
+	// DefaultDecoderOptions are used by every new Decoder, and so by Decode
+	// and DecodeFromBytes, unless they are replaced with SetOptions.
+	DefaultDecoderOptions = DecoderOptions{
+		MaxDepth:     512,
+		MaxStringLen: 1 << 28,
+	}
+)
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func limitError(err error, off int64) error { return fmt.Errorf("%w at offset %d", err, off) }
+
+func (d *Decoder) SetOptions(opts DecoderOptions) { d.opts = opts }
+
+func (d *Decoder) Options() DecoderOptions { return d.opts }
+
+func (d *Decoder) checkDepth(off int64) error {
+	if d.opts.MaxDepth > 0 && len(d.stack) >= d.opts.MaxDepth {
+		return limitError(ErrMaxDepth, off)
+	}
+	return nil
+}
+
+func (d *Decoder) checkString(strLen, off int64) error {
+	if d.opts.MaxStringLen > 0 && strLen > d.opts.MaxStringLen {
+		return limitError(ErrMaxStringLen, off)
+	}
+	return d.checkTotal(d.Offset() + strLen)
+}
+
+func (d *Decoder) checkTotal(total int64) error {
+	if d.opts.MaxTotalBytes > 0 && total > d.opts.MaxTotalBytes {
+		return limitError(ErrMaxTotalBytes, d.Offset())
+	}
+	return nil
+}
+
+// checkElement counts the value starting with c towards MaxElements.
+func (d *Decoder) checkElement(c byte, off int64) error {
+	if err := d.checkTotal(d.Offset()); err != nil {
+		return err
+	}
+	if c == end {
+		return nil
+	}
+	d.count++
+	if d.opts.MaxElements > 0 && d.count > d.opts.MaxElements {
+		return limitError(ErrMaxElements, off)
+	}
+	return nil
+}
+
+// DecodeWithOptions is like Decode but with the given limits in place of
+// DefaultDecoderOptions.
+func DecodeWithOptions(r io.Reader, opts DecoderOptions) (Bencoder, error) {
+	dec := NewDecoder(r)
+	dec.SetOptions(opts)
+	return decodeFrom(dec)
+}
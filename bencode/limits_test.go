@@ -0,0 +1,59 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecoderLimits(t *testing.T) {
+	opts := DecoderOptions{MaxDepth: 2, MaxStringLen: 4, MaxTotalBytes: 32, MaxElements: 5}
+	for input, expected := range map[string]error{
+		"llli1eeee":                           ErrMaxDepth,
+		"5:spams":                             ErrMaxStringLen,
+		"li1234567890ei1234567890ei12345678e": ErrMaxTotalBytes,
+		"i1234567890123456789012345678901e":   ErrMaxTotalBytes,
+		"li1ei2ei3ei4ei5ee":                   ErrMaxElements,
+	} {
+		for _, dec := range []*Decoder{NewDecoder(strings.NewReader(input)), NewBytesDecoder([]byte(input))} {
+			dec.SetOptions(opts)
+			if _, err := dec.Value(); !errors.Is(err, expected) {
+				t.Fatal("expected", expected, "for", input, "but got", err)
+			}
+		}
+	}
+	for _, input := range []string{"lli1eee", "4:spam", "li1ei2ei3ei4ee"} {
+		dec := NewBytesDecoder([]byte(input))
+		dec.SetOptions(opts)
+		if _, err := dec.Value(); err != nil {
+			t.Fatal("input within limits was rejected", input, err)
+		}
+	}
+}
+
+func TestDecodeHugeStringLength(t *testing.T) {
+	// the length prefix must not be trusted when allocating
+	_, err := Decode(strings.NewReader("268435456:abc"))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected unexpected eof but got", err)
+	}
+	_, err = Decode(strings.NewReader("268435457:abc"))
+	if !errors.Is(err, ErrMaxStringLen) {
+		t.Fatal("expected default string limit to apply but got", err)
+	}
+	_, err = DecodeFromBytes(bytes.Repeat([]byte("l"), DefaultDecoderOptions.MaxDepth+1))
+	if !errors.Is(err, ErrMaxDepth) {
+		t.Fatal("expected default depth limit to apply but got", err)
+	}
+}
+
+func TestDecodeWithOptions(t *testing.T) {
+	if _, err := DecodeWithOptions(bytes.NewReader(realWorldData), DecoderOptions{MaxStringLen: 1 << 10}); !errors.Is(err, ErrMaxStringLen) {
+		t.Fatal("expected pieces string to exceed limit but got", err)
+	}
+	if _, err := DecodeWithOptions(bytes.NewReader(realWorldData), DecoderOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
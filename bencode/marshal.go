@@ -0,0 +1,396 @@
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+type (
+	// Marshaler is implemented by types that can bencode themselves.
+	Marshaler interface {
+		MarshalBencode() ([]byte, error)
+	}
+	// Unmarshaler is implemented by types that can decode their own bencoding.
+	Unmarshaler interface {
+		UnmarshalBencode([]byte) error
+	}
+	field struct {
+		name      String
+		index     []int
+		omitEmpty bool
+	}
+)
+
+const (
+	tagName      = "bencode"
+	tagOmitEmpty = "omitempty"
+	tagSkip      = "-"
+)
+
+var (
+	bencoderType    = reflect.TypeOf((*Bencoder)(nil)).Elem()
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// Marshal returns the bencoding of v. Structs are encoded as dicts using the
+// bencode:"name,omitempty" field tags, falling back to the field name.
+func Marshal(v interface{}) ([]byte, error) {
+	val, err := ValueOf(v)
+	if err != nil {
+		return nil, err
+	}
+	return val.Bytes(), nil
+}
+
+// Unmarshal decodes data and stores the result in the value pointed to by v.
+// Dict keys are matched to struct fields by tag and unknown keys are ignored.
+// An Unmarshaler is handed the bytes its value was decoded from in data.
+func Unmarshal(data []byte, v interface{}) error {
+	val, span, err := DecodeWithSpans(data)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return errors.New("no value could be decoded from data")
+	}
+	dst := reflect.ValueOf(v)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return errors.New("can only unmarshal to non nil ptr")
+	}
+	return spanned{val, data, span}.Unmarshal(dst)
+}
+
+// ValueOf converts a Go value into the equivalent Bencoder tree.
+func ValueOf(v interface{}) (Bencoder, error) {
+	if v == nil {
+		return nil, errors.New("cannot marshal nil value")
+	}
+	return valueOf(reflect.ValueOf(v))
+}
+
+func valueOf(v reflect.Value) (Bencoder, error) {
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		v = v.Addr()
+	}
+	if v.Type().Implements(marshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return nil, errors.New("cannot marshal nil Marshaler")
+		}
+		return marshalWith(v.Interface().(Marshaler))
+	}
+	if v.Type().Implements(bencoderType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return nil, errors.New("cannot marshal nil Bencoder")
+		}
+		return v.Interface().(Bencoder), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, errors.New("cannot marshal nil " + v.Type().String())
+		}
+		return valueOf(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return I(1), nil
+		}
+		return I(0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return I(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return BigI(new(big.Int).SetUint64(u)), nil
+		}
+		return I(int64(u)), nil
+	case reflect.String:
+		return S(v.String()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return StringFromBytes(append([]byte(nil), v.Bytes()...)), nil
+		}
+		return listOf(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s := make(String, v.Len())
+			reflect.Copy(reflect.ValueOf(s), v)
+			return s, nil
+		}
+		return listOf(v)
+	case reflect.Map:
+		return dictOfMap(v)
+	case reflect.Struct:
+		if v.Type() == bigIntType {
+			x := v.Interface().(big.Int)
+			return BigI(new(big.Int).Set(&x)), nil
+		}
+		return dictOfStruct(v)
+	}
+	return nil, errors.New("cannot marshal value of type " + v.Type().String())
+}
+
+func marshalWith(m Marshaler) (Bencoder, error) {
+	data, err := m.MarshalBencode()
+	if err != nil {
+		return nil, err
+	}
+	val, err := DecodeFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, errors.New("MarshalBencode returned no value")
+	}
+	return val, nil
+}
+
+func listOf(v reflect.Value) (List, error) {
+	l := make(List, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elem, err := valueOf(v.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, elem)
+	}
+	return l, nil
+}
+
+func dictOfMap(v reflect.Value) (Dict, error) {
+	if v.Type().Key().Kind() != reflect.String {
+		return nil, errors.New("map keys must be strings, got " + v.Type().Key().String())
+	}
+	pairs := make([]Pair, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		val, err := valueOf(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, P(S(iter.Key().String()), val))
+	}
+	return D(pairs...), nil
+}
+
+func dictOfStruct(v reflect.Value) (Dict, error) {
+	fs := fields(v.Type())
+	pairs := make([]Pair, 0, len(fs))
+	for _, f := range fs {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && isEmpty(fv)) {
+			continue
+		}
+		val, err := valueOf(fv)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name.Raw(), err)
+		}
+		pairs = append(pairs, P(f.name, val))
+	}
+	return D(pairs...), nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex except that it reports
+// false instead of panicking when it runs into a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func parseTag(f reflect.StructField) (name string, omitEmpty, ok bool) {
+	tag := f.Tag.Get(tagName)
+	if tag == tagSkip {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == tagOmitEmpty {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty, true
+}
+
+// fields lists the encodable fields of struct type t in declaration order.
+// Untagged embedded structs have their fields promoted into the parent.
+func fields(t reflect.Type) []field {
+	ret := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, omitEmpty, ok := parseTag(sf)
+		if !ok {
+			continue
+		}
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, inner := range fields(ft) {
+					inner.index = append([]int{i}, inner.index...)
+					ret = append(ret, inner)
+				}
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		ret = append(ret, field{S(name), []int{i}, omitEmpty})
+	}
+	return ret
+}
+
+// findField returns the field named k. Keys are byte strings so they must
+// match exactly.
+func findField(fs []field, k String) (field, bool) {
+	for _, f := range fs {
+		if f.name.Equal(k) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// settable dereferences the ptr dst, allocating any nil pointers along the
+// way, and returns the value that should be set.
+func settable(dst reflect.Value, kind string) (reflect.Value, error) {
+	if dst.Kind() != reflect.Ptr {
+		return reflect.Value{}, errors.New("(" + kind + ") can only unmarshal to ptr")
+	}
+	if dst.IsNil() {
+		return reflect.Value{}, errors.New("(" + kind + ") cannot unmarshal to nil ptr")
+	}
+	e := dst.Elem()
+	for e.Kind() == reflect.Ptr {
+		if e.IsNil() {
+			if !e.CanSet() {
+				return reflect.Value{}, errors.New("(" + kind + ") cannot set field")
+			}
+			e.Set(reflect.New(e.Type().Elem()))
+		}
+		e = e.Elem()
+	}
+	if !e.CanSet() {
+		return reflect.Value{}, errors.New("(" + kind + ") cannot set field")
+	}
+	return e, nil
+}
+
+// unmarshalWith hands the bencoding of b to e if e implements Unmarshaler.
+func unmarshalWith(e reflect.Value, b Bencoder) (bool, error) {
+	if pt := reflect.PtrTo(e.Type()); pt.Implements(unmarshalerType) {
+		return true, e.Addr().Interface().(Unmarshaler).UnmarshalBencode(b.Bytes())
+	}
+	return false, nil
+}
+
+// setBencoder stores b in e if e is an interface that b satisfies.
+func setBencoder(e reflect.Value, b Bencoder) bool {
+	if e.Kind() == reflect.Interface && reflect.TypeOf(b).Implements(e.Type()) {
+		e.Set(reflect.ValueOf(b))
+		return true
+	}
+	return false
+}
+
+func unmarshalToStruct(d Dict, e reflect.Value) error {
+	fs := fields(e.Type())
+	for _, p := range d {
+		f, ok := findField(fs, p.Key)
+		if !ok {
+			continue
+		}
+		fv := e
+		for i, x := range f.index {
+			if i > 0 && fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(x)
+		}
+		if err := p.Value.Unmarshal(fv.Addr()); err != nil {
+			return fmt.Errorf("field %s: %w", f.name.Raw(), err)
+		}
+	}
+	return nil
+}
+
+// unmarshalToMap adds the pairs in d to the map e, which may have any key
+// type whose underlying type is string.
+func unmarshalToMap(d Dict, e reflect.Value) error {
+	t := e.Type()
+	if t.Key().Kind() != reflect.String {
+		return errors.New("(Dict) map keys must be strings")
+	}
+	if e.IsNil() {
+		e.Set(reflect.MakeMapWithSize(t, d.Len()))
+	}
+	for _, p := range d {
+		val := reflect.New(t.Elem())
+		if err := p.Value.Unmarshal(val); err != nil {
+			return fmt.Errorf("key %s: %w", p.Key.Raw(), err)
+		}
+		e.SetMapIndex(reflect.ValueOf(p.Key.Raw()).Convert(t.Key()), val.Elem())
+	}
+	return nil
+}
+
+// unmarshalToSlice fills the slice or array e with the elements of l. Arrays
+// must have exactly as many elements as l.
+func unmarshalToSlice(l List, e reflect.Value) error {
+	s := e
+	if e.Kind() == reflect.Array {
+		if e.Len() != l.Len() {
+			return errors.New("(List) length does not match array length")
+		}
+	} else {
+		s = reflect.MakeSlice(e.Type(), l.Len(), l.Len())
+	}
+	for i, val := range l {
+		if err := val.Unmarshal(s.Index(i).Addr()); err != nil {
+			return fmt.Errorf("index %d: %w", i, err)
+		}
+	}
+	e.Set(s)
+	return nil
+}
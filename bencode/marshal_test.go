@@ -0,0 +1,216 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type (
+	marshalInner struct {
+		Name   string `bencode:"name"`
+		Length int64  `bencode:"length,omitempty"`
+	}
+	marshalEmbedded struct {
+		Comment string `bencode:"comment,omitempty"`
+	}
+	marshalStruct struct {
+		marshalEmbedded
+		Announce string            `bencode:"announce"`
+		Hash     []byte            `bencode:"hash"`
+		Files    []marshalInner    `bencode:"files"`
+		Info     *marshalInner     `bencode:"info"`
+		Meta     map[string]string `bencode:"meta,omitempty"`
+		Private  bool              `bencode:"private,omitempty"`
+		Skipped  string            `bencode:"-"`
+		Raw      Bencoder          `bencode:"raw,omitempty"`
+		hidden   string
+	}
+)
+
+func TestMarshal(t *testing.T) {
+	v := marshalStruct{
+		marshalEmbedded: marshalEmbedded{"hi"},
+		Announce:        "udp://tracker",
+		Hash:            []byte{0, 1, 2},
+		Files:           []marshalInner{{"a", 1}, {"b", 0}},
+		Info:            &marshalInner{"c", 3},
+		Private:         true,
+		Skipped:         "skipped",
+		hidden:          "hidden",
+	}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "d8:announce13:udp://tracker7:comment2:hi5:filesld6:lengthi1e4:name1:aed4:name1:bee" +
+		"4:hash3:\x00\x01\x024:infod6:lengthi3e4:name1:ce7:privatei1ee"
+	if string(data) != expected {
+		t.Fatal("struct did not marshal as expected", string(data))
+	}
+}
+
+func TestMarshalMap(t *testing.T) {
+	data, err := Marshal(map[string]int{"b": 2, "a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d1:ai1e1:bi2ee" {
+		t.Fatal("map did not marshal with sorted keys", string(data))
+	}
+	if _, err := Marshal(map[int]int{1: 1}); err == nil {
+		t.Fatal("map with non string keys should not marshal")
+	}
+	if _, err := Marshal(1.5); err == nil {
+		t.Fatal("float should not marshal")
+	}
+}
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	v := marshalStruct{
+		marshalEmbedded: marshalEmbedded{"hi"},
+		Announce:        "udp://tracker",
+		Hash:            []byte{0, 1, 2},
+		Files:           []marshalInner{{"a", 1}, {"b", 0}},
+		Info:            &marshalInner{"c", 3},
+		Meta:            map[string]string{"k": "v"},
+		Private:         true,
+		Raw:             L(I(1)),
+	}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := marshalStruct{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, out) {
+		t.Fatal("struct did not survive a round trip", v, out)
+	}
+}
+
+func TestUnmarshalUnknownKeys(t *testing.T) {
+	out := marshalInner{}
+	if err := Unmarshal([]byte("d5:extrali1ee6:lengthi7e4:name3:abc1:zi0ee"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "abc" || out.Length != 7 {
+		t.Fatal("unknown keys interfered with unmarshalling", out)
+	}
+}
+
+func TestUnmarshalKeysAreCaseSensitive(t *testing.T) {
+	out := marshalInner{}
+	if err := Unmarshal([]byte("d4:NAME3:abc4:Namei1e4:name3:defe"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "def" {
+		t.Fatal("keys that only match case insensitively should be ignored", out)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var small int8
+	if err := Unmarshal([]byte("i300e"), &small); err == nil {
+		t.Fatal("int that overflows field should not unmarshal")
+	}
+	var u uint
+	if err := Unmarshal([]byte("i-1e"), &u); err == nil {
+		t.Fatal("negative int should not unmarshal into uint")
+	}
+	out := marshalInner{}
+	if err := Unmarshal([]byte("d4:namei1ee"), &out); err == nil {
+		t.Fatal("int should not unmarshal into string field")
+	}
+	if err := Unmarshal([]byte("4:spam"), out); err == nil {
+		t.Fatal("should not unmarshal into non pointer")
+	}
+}
+
+type hexID [2]byte
+
+func (h hexID) MarshalBencode() ([]byte, error) {
+	return Marshal(fmt.Sprintf("%02x%02x", h[0], h[1]))
+}
+
+func (h *hexID) UnmarshalBencode(data []byte) error {
+	var s string
+	if err := Unmarshal(data, &s); err != nil {
+		return err
+	}
+	_, err := fmt.Sscanf(s, "%02x%02x", &h[0], &h[1])
+	return err
+}
+
+func TestMarshaler(t *testing.T) {
+	v := struct {
+		ID  hexID  `bencode:"id"`
+		Ptr *hexID `bencode:"ptr"`
+	}{hexID{1, 255}, &hexID{16, 0}}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d2:id4:01ff3:ptr4:1000e" {
+		t.Fatal("Marshaler was not used when encoding", string(data))
+	}
+	out := v
+	out.ID, out.Ptr = hexID{}, nil
+	if err := D(P(S("id"), S("01ff")), P(S("ptr"), S("1000"))).Unmarshal(reflect.ValueOf(&out)); err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != v.ID || out.Ptr == nil || *out.Ptr != *v.Ptr {
+		t.Fatal("Unmarshaler was not used when decoding", out)
+	}
+}
+
+type extName string
+
+func TestUnmarshalNestedCollections(t *testing.T) {
+	v := struct {
+		AnnounceList [][]string        `bencode:"announce-list"`
+		M            map[extName]int64 `bencode:"m"`
+		ID           [4]byte           `bencode:"id"`
+		Pair         [2]int            `bencode:"pair"`
+		Nested       map[string][]Int  `bencode:"nested"`
+		Any          []interface{}     `bencode:"any"`
+	}{}
+	data := "d13:announce-listll1:a1:bel1:cee3:anyli1e1:xe2:id4:abcd" +
+		"1:md11:ut_metadatai2e6:ut_pexi1ee6:nestedd1:kli1ei2eee4:pairli7ei8eee"
+	if err := Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.AnnounceList) != 2 || len(v.AnnounceList[0]) != 2 || v.AnnounceList[1][0] != "c" {
+		t.Fatal("announce list did not unmarshal", v.AnnounceList)
+	}
+	if v.M["ut_metadata"] != 2 || v.M["ut_pex"] != 1 || len(v.M) != 2 {
+		t.Fatal("extension map did not unmarshal", v.M)
+	}
+	if string(v.ID[:]) != "abcd" || v.Pair != [2]int{7, 8} {
+		t.Fatal("arrays did not unmarshal", v.ID, v.Pair)
+	}
+	if len(v.Nested["k"]) != 2 || v.Nested["k"][1] != 2 {
+		t.Fatal("map of slices did not unmarshal", v.Nested)
+	}
+	if v.Any[0] != I(1) || v.Any[1].(String).Raw() != "x" {
+		t.Fatal("interface slice did not unmarshal", v.Any)
+	}
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != data {
+		t.Fatal("nested collections did not marshal back to input", string(out))
+	}
+	short := struct {
+		ID   [5]byte `bencode:"id"`
+		Pair [3]int  `bencode:"pair"`
+	}{}
+	if err := Unmarshal([]byte("d2:id4:abcde"), &short); err == nil {
+		t.Fatal("String should not unmarshal into array of different length")
+	}
+	if err := Unmarshal([]byte("d4:pairli1eee"), &short); err == nil {
+		t.Fatal("List should not unmarshal into array of different length")
+	}
+}
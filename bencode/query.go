@@ -0,0 +1,289 @@
+package bencode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Results holds every value matched by a Query, in order.
+	Results []Bencoder
+	// PathError reports the segment of a path that could not be followed.
+	PathError struct {
+		Path, Segment, Reason string
+	}
+	stepKind int
+	step     struct {
+		kind  stepKind
+		key   String
+		index int
+		text  string
+	}
+)
+
+const (
+	stepKey stepKind = iota
+	stepIndex
+	stepWildcard
+	pathSep  = '.'
+	pathEsc  = '\\'
+	wildcard = "*"
+)
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("bencode: path %q not found at segment %q: %s", e.Path, e.Segment, e.Reason)
+}
+
+// parsePath splits a path such as info.files[*].path[0] into steps. Dict keys
+// are separated by dots, list indices are written in brackets and * matches
+// every element of a list or every value of a dict. A backslash escapes the
+// character after it inside of a key, so \* is a key named * rather than a
+// wildcard. Keys cannot be empty, so a path cannot start or end with a dot or
+// have a dot right before another dot or a bracket.
+func parsePath(path string) ([]step, error) {
+	steps, key, escaped, inKey := make([]step, 0), strings.Builder{}, false, false
+	// literal is set when the current key had an escape in it and afterSep
+	// when a dot was the last thing read
+	literal, afterSep := false, false
+	empty := &PathError{path, "", "empty key"}
+	flush := func() {
+		if inKey {
+			k := key.String()
+			if k == wildcard && !literal {
+				steps = append(steps, step{stepWildcard, nil, 0, k})
+			} else {
+				steps = append(steps, step{stepKey, S(k), 0, k})
+			}
+		}
+		key.Reset()
+		inKey, literal = false, false
+	}
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case escaped:
+			key.WriteByte(c)
+			escaped, inKey, literal, afterSep = false, true, true, false
+		case c == pathEsc:
+			escaped = true
+		case c == pathSep:
+			if !inKey && (i == 0 || path[i-1] != ']') {
+				return nil, empty
+			}
+			flush()
+			afterSep = true
+		case c == '[':
+			if afterSep && !inKey {
+				return nil, empty
+			}
+			flush()
+			afterSep = false
+			j := strings.IndexByte(path[i:], ']')
+			if j < 0 {
+				return nil, &PathError{path, path[i:], "unterminated index"}
+			}
+			text := path[i : i+j+1]
+			if inner := text[1 : len(text)-1]; inner == wildcard {
+				steps = append(steps, step{stepWildcard, nil, 0, text})
+			} else if idx, err := strconv.Atoi(inner); err == nil && idx >= 0 {
+				steps = append(steps, step{stepIndex, nil, idx, text})
+			} else {
+				return nil, &PathError{path, text, "invalid index"}
+			}
+			i += j
+		default:
+			key.WriteByte(c)
+			inKey, afterSep = true, false
+		}
+	}
+	if escaped {
+		return nil, &PathError{path, path, "path ends with an escape"}
+	}
+	if afterSep && !inKey {
+		return nil, empty
+	}
+	flush()
+	return steps, nil
+}
+
+func (s step) follow(path string, v Bencoder, out Results) (Results, error) {
+	switch s.kind {
+	case stepKey:
+		d, ok := v.(Dict)
+		if !ok {
+			return nil, &PathError{path, s.text, "value is not a Dict"}
+		}
+		val := d.Get(s.key)
+		if val == nil {
+			return nil, &PathError{path, s.text, "no such key in dict"}
+		}
+		return append(out, val), nil
+	case stepIndex:
+		l, ok := v.(List)
+		if !ok {
+			return nil, &PathError{path, s.text, "value is not a List"}
+		}
+		if s.index >= l.Len() {
+			return nil, &PathError{path, s.text, "index out of range"}
+		}
+		return append(out, l[s.index]), nil
+	}
+	switch t := v.(type) {
+	case List:
+		return append(out, t...), nil
+	case Dict:
+		for _, p := range t {
+			out = append(out, p.Value)
+		}
+		return out, nil
+	}
+	return nil, &PathError{path, s.text, "value is not a List or Dict"}
+}
+
+// Query returns every value in v that matches path. An empty path matches v.
+func Query(v Bencoder, path string) (Results, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	cur := Results{v}
+	for _, s := range steps {
+		next := make(Results, 0, len(cur))
+		for _, val := range cur {
+			if next, err = s.follow(path, val, next); err != nil {
+				return nil, err
+			}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// HasWildcard reports whether path uses a wildcard, in which case Query may
+// match any number of values and Lookup rejects it.
+func HasWildcard(path string) (bool, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range steps {
+		if s.kind == stepWildcard {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Lookup returns the single value in v at path, which may not use wildcards.
+func Lookup(v Bencoder, path string) (Bencoder, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		if s.kind == stepWildcard {
+			return nil, &PathError{path, s.text, "wildcards are not allowed in Lookup"}
+		}
+		res, err := s.follow(path, v, make(Results, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		v = res[0]
+	}
+	return v, nil
+}
+
+func (d Dict) Lookup(path string) (Bencoder, error) { return Lookup(d, path) }
+
+func (d Dict) LookupString(path string) (String, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := v.(String); ok {
+		return s, nil
+	}
+	return nil, &PathError{path, path, "value is not a String"}
+}
+
+func (d Dict) LookupInt(path string) (Int, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return 0, err
+	}
+	if i, ok := v.(Int); ok {
+		return i, nil
+	}
+	return 0, &PathError{path, path, "value is not an Int"}
+}
+
+func (d Dict) LookupList(path string) (List, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := v.(List); ok {
+		return l, nil
+	}
+	return nil, &PathError{path, path, "value is not a List"}
+}
+
+func (d Dict) LookupDict(path string) (Dict, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if dd, ok := v.(Dict); ok {
+		return dd, nil
+	}
+	return nil, &PathError{path, path, "value is not a Dict"}
+}
+
+func (r Results) Strings() ([]String, error) {
+	ret := make([]String, 0, len(r))
+	for i, v := range r {
+		s, ok := v.(String)
+		if !ok {
+			return nil, fmt.Errorf("bencode: result %d is not a String", i)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func (r Results) Ints() ([]Int, error) {
+	ret := make([]Int, 0, len(r))
+	for i, v := range r {
+		n, ok := v.(Int)
+		if !ok {
+			return nil, fmt.Errorf("bencode: result %d is not an Int", i)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func (r Results) Lists() ([]List, error) {
+	ret := make([]List, 0, len(r))
+	for i, v := range r {
+		l, ok := v.(List)
+		if !ok {
+			return nil, fmt.Errorf("bencode: result %d is not a List", i)
+		}
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
+
+func (r Results) Dicts() ([]Dict, error) {
+	ret := make([]Dict, 0, len(r))
+	for i, v := range r {
+		d, ok := v.(Dict)
+		if !ok {
+			return nil, fmt.Errorf("bencode: result %d is not a Dict", i)
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
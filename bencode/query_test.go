@@ -0,0 +1,117 @@
+package bencode
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	v, err := DecodeFromBytes(realWorldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Query(v, "announce-list[*][0]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := res.Strings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls[1].Raw() != "https://ipv6.torrent.ubuntu.com/announce" {
+		t.Fatal("unexpected announce urls", urls)
+	}
+	res, err = Query(v, "info.piece length")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lengths, err := res.Ints(); err != nil || len(lengths) != 1 || lengths[0] != 262144 {
+		t.Fatal("unexpected piece length", lengths, err)
+	}
+	if _, err := res.Strings(); err == nil {
+		t.Fatal("Int result should not convert to Strings")
+	}
+	if res, err = Query(v, ""); err != nil || len(res) != 1 {
+		t.Fatal("empty path should match the root", res, err)
+	}
+}
+
+func TestQueryWildcards(t *testing.T) {
+	d := D(P(S("info"), D(P(S("files"), L(
+		D(P(S("length"), I(1)), P(S("path"), L(S("a"), S("b")))),
+		D(P(S("length"), I(2)), P(S("path"), L(S("c")))),
+	)))))
+	res, err := Query(d, "info.files[*].length")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lengths, err := res.Ints(); err != nil || len(lengths) != 2 || lengths[0] != 1 || lengths[1] != 2 {
+		t.Fatal("unexpected lengths", lengths, err)
+	}
+	res, err = Query(d, "info.files.*.path.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[2].(String).Raw() != "c" {
+		t.Fatal("unexpected paths", res)
+	}
+	if res, err = Query(d, "info.*.*.*"); err != nil || len(res) != 4 {
+		t.Fatal("dict wildcard did not match every value", res, err)
+	}
+	star := D(P(S("*"), I(1)), P(S("a"), I(2)))
+	if res, err = Query(star, `\*`); err != nil || len(res) != 1 || res[0] != I(1) {
+		t.Fatal("escaped * should match the key named *", res, err)
+	}
+	if v, err := Lookup(star, `\*`); err != nil || v != I(1) {
+		t.Fatal("escaped * should be allowed in Lookup", v, err)
+	}
+	for path, expected := range map[string]bool{"a.*": true, "a[*]": true, `a.\*`: false, "a*": false, "a[0]": false} {
+		if wild, err := HasWildcard(path); err != nil || wild != expected {
+			t.Fatal("wrong wildcard report for", path, wild, err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	d := D(
+		P(S("r"), D(P(S("id"), S("abc")), P(S("nodes"), S("xyz")), P(S("n"), I(3)))),
+		P(S("a.b"), L(S("dotted"))),
+	)
+	if s, err := d.LookupString("r.nodes"); err != nil || s.Raw() != "xyz" {
+		t.Fatal("unexpected lookup result", s, err)
+	}
+	if i, err := d.LookupInt("r.n"); err != nil || i != 3 {
+		t.Fatal("unexpected lookup result", i, err)
+	}
+	if s, err := d.LookupString(`a\.b[0]`); err != nil || s.Raw() != "dotted" {
+		t.Fatal("escaped key lookup failed", s, err)
+	}
+	if _, err := d.LookupDict("r"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.LookupList("r"); err == nil {
+		t.Fatal("lookup of Dict as List should fail")
+	}
+	for path, segment := range map[string]string{
+		"r.values": "values",
+		"r.id.x":   "x",
+		"r[0]":     "[0]",
+		"r.*":      "*",
+		"a\\.b[1]": "[1]",
+		"r[x]":     "[x]",
+		"r..id":    "",
+		".r":       "",
+		"r.":       "",
+		"r.[0]":    "",
+		"r[0].":    "",
+	} {
+		_, err := d.Lookup(path)
+		var pe *PathError
+		if !errors.As(err, &pe) {
+			t.Fatal("expected path error for", path, "but got", err)
+		}
+		if pe.Segment != segment {
+			t.Fatal("path error for", path, "had wrong segment", pe.Segment)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+)
+
+type (
+	// RawMessage is a verbatim bencoded value. It is written out exactly as
+	// is, which makes it suitable for hashing values like a torrent's info dict.
+	RawMessage []byte
+	// Span is the location of a value in the input of a Decoder. Elems holds
+	// the spans of the elements of a List, or of the values of a Dict, in the
+	// order they appeared in the input.
+	Span struct {
+		Start, End int64
+		Elems      []Span
+	}
+	// spanned is a decoded value along with the input it was decoded from
+	// and its Span in it, so that Unmarshalers can be handed the original
+	// bytes of the value instead of a re-encoding.
+	spanned struct {
+		Bencoder
+		data []byte
+		span Span
+	}
+)
+
+func (r RawMessage) decode() (Bencoder, error) {
+	v, err := DecodeFromBytes(r)
+	if err == nil && v == nil {
+		err = errors.New("RawMessage is empty")
+	}
+	return v, err
+}
+
+func (r RawMessage) Bencode(w *Writer) error { return w.Write(r).err }
+
+func (r RawMessage) Unmarshal(dst reflect.Value) error {
+	v, err := r.decode()
+	if err != nil {
+		return err
+	}
+	return v.Unmarshal(dst)
+}
+
+func (r RawMessage) Pretty(ind, indInc string) string {
+	v, err := r.decode()
+	if err != nil {
+		return ind + err.Error() + "\n"
+	}
+	return v.Pretty(ind, indInc)
+}
+
+func (r RawMessage) AppendBencode(dst []byte) []byte { return append(dst, r...) }
+
+func (r RawMessage) Bytes() []byte  { return r }
+func (r RawMessage) String() string { return string(r) }
+
+func (r RawMessage) MarshalBencode() ([]byte, error) { return r, nil }
+
+func (r *RawMessage) UnmarshalBencode(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
+
+// Unmarshal stores the value in dst like the Bencoder it holds, except that an
+// Unmarshaler gets the original bytes of the value and so does any Unmarshaler
+// found in the elements of a List or Dict that is unmarshalled into a struct,
+// map, slice or array.
+func (s spanned) Unmarshal(dst reflect.Value) error {
+	e, err := settable(dst, "Raw")
+	if err != nil {
+		return err
+	}
+	if reflect.PtrTo(e.Type()).Implements(unmarshalerType) {
+		return e.Addr().Interface().(Unmarshaler).UnmarshalBencode(s.span.Bytes(s.data))
+	}
+	switch v := s.Bencoder.(type) {
+	case List:
+		if k := e.Kind(); len(v) == len(s.span.Elems) && e.Type() != reflect.TypeOf(v) &&
+			(k == reflect.Slice || k == reflect.Array || k == reflect.Struct) {
+			l := make(List, len(v))
+			for i, elem := range v {
+				l[i] = spanned{elem, s.data, s.span.Elems[i]}
+			}
+			return l.Unmarshal(dst)
+		}
+	case Dict:
+		if k := e.Kind(); len(v) == len(s.span.Elems) && (k == reflect.Struct || k == reflect.Map) {
+			d := make(Dict, len(v))
+			for i, p := range v {
+				d[i] = P(p.Key, spanned{p.Value, s.data, s.span.Elems[i]})
+			}
+			return d.Unmarshal(dst)
+		}
+	}
+	return s.Bencoder.Unmarshal(dst)
+}
+
+// RecordSpans makes the decoder record the Span of every value it decodes
+// with Value or Decode. The result is available from Span.
+func (d *Decoder) RecordSpans(on bool) { d.spans = on }
+
+// Span returns the location of the value most recently read by Value or
+// Decode when RecordSpans is on.
+func (d *Decoder) Span() Span { return d.span }
+
+// Raw reads the next value from the input stream and returns its original
+// bytes without building it.
+func (d *Decoder) Raw() (RawMessage, error) {
+	d.src.mark()
+	err := d.Skip()
+	raw := d.src.captured()
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// DecodeWithSpans decodes the first value in data and records its Span.
+func DecodeWithSpans(data []byte) (Bencoder, Span, error) {
+	dec := newDecoder(&bytesSource{data: data})
+	dec.RecordSpans(true)
+	v, err := dec.Value()
+	return v, dec.Span(), err
+}
+
+func (s Span) Len() int64 { return s.End - s.Start }
+
+// Bytes returns the bytes covered by s in data, which must be the input the
+// span was recorded from.
+func (s Span) Bytes(data []byte) RawMessage {
+	if s.Start < 0 || s.End > int64(len(data)) || s.Start > s.End {
+		return nil
+	}
+	return RawMessage(data[s.Start:s.End:s.End])
+}
+
+// Index returns the span of element i of the List that s covers.
+func (s Span) Index(i int) (Span, bool) {
+	if i < 0 || i >= len(s.Elems) {
+		return Span{}, false
+	}
+	return s.Elems[i], true
+}
+
+// Key returns the span of the value for k in d, where s is the span of d.
+func (s Span) Key(d Dict, k String) (Span, bool) {
+	if len(d) != len(s.Elems) {
+		return Span{}, false
+	}
+	for i, p := range d {
+		if p.Key.Equal(k) {
+			return s.Elems[i], true
+		}
+	}
+	return Span{}, false
+}
@@ -0,0 +1,136 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+const realWorldInfoHash = "64a980abe6e448226bb930ba061592e44c3781a1"
+
+func TestDecodeWithSpans(t *testing.T) {
+	v, span, err := DecodeWithSpans(realWorldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if span.Start != 0 || span.End != int64(len(realWorldData)) {
+		t.Fatal("root span does not cover the whole torrent", span.Start, span.End)
+	}
+	infoSpan, ok := span.Key(v.(Dict), S("info"))
+	if !ok {
+		t.Fatal("could not find span for info dict")
+	}
+	info := infoSpan.Bytes(realWorldData)
+	if !bytes.Equal(info, v.(Dict).Get(S("info")).Bytes()) {
+		t.Fatal("info span does not match the info dict")
+	}
+	hash := sha1.Sum(info)
+	if hex.EncodeToString(hash[:]) != realWorldInfoHash {
+		t.Fatal("info hash was wrong", hex.EncodeToString(hash[:]))
+	}
+}
+
+func TestSpansNested(t *testing.T) {
+	data := []byte("d1:bl1:xi12ee1:ai1ee")
+	v, span, err := DecodeWithSpans(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bSpan, ok := span.Key(v.(Dict), S("b"))
+	if !ok || bSpan.Bytes(data).String() != "l1:xi12ee" {
+		t.Fatal("wrong span for unsorted key b", bSpan)
+	}
+	elem, ok := bSpan.Index(1)
+	if !ok || elem.Bytes(data).String() != "i12e" {
+		t.Fatal("wrong span for list element", elem)
+	}
+	if _, ok := bSpan.Index(2); ok {
+		t.Fatal("found span for index out of bounds")
+	}
+	aSpan, ok := span.Key(v.(Dict), S("a"))
+	if !ok || aSpan.Bytes(data).String() != "i1e" {
+		t.Fatal("wrong span for key a", aSpan)
+	}
+}
+
+func TestDecoderRaw(t *testing.T) {
+	for _, dec := range []*Decoder{
+		NewDecoder(strings.NewReader("d1:ald1:xi1eee1:b3:fooe")),
+		NewBytesDecoder([]byte("d1:ald1:xi1eee1:b3:fooe")),
+	} {
+		if _, err := dec.Token(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dec.Token(); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := dec.Raw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw.String() != "ld1:xi1eee" {
+			t.Fatal("raw value was not captured verbatim", raw.String())
+		}
+		if _, err := dec.Token(); err != nil {
+			t.Fatal(err)
+		}
+		if raw, err = dec.Raw(); err != nil || raw.String() != "3:foo" {
+			t.Fatal("raw string was not captured verbatim", raw, err)
+		}
+	}
+}
+
+func TestRawMessageMarshal(t *testing.T) {
+	v := struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}{}
+	if err := Unmarshal([]byte("d4:infod1:ai1ee4:name1:xe"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Info.String() != "d1:ai1ee" || v.Name != "x" {
+		t.Fatal("raw message was not unmarshalled", v.Info.String())
+	}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d4:infod1:ai1ee4:name1:xe" {
+		t.Fatal("raw message was not marshalled verbatim", string(data))
+	}
+}
+
+// rawCapture keeps the bytes it is unmarshalled from without copying them.
+type rawCapture []byte
+
+func (c *rawCapture) UnmarshalBencode(data []byte) error {
+	*c = data
+	return nil
+}
+
+func TestUnmarshalPassesOriginalBytes(t *testing.T) {
+	data := []byte("d4:infod1:bi1e1:ai2ee4:listld1:xi1eee3:mapd1:kli3eeee")
+	v := struct {
+		Info rawCapture            `bencode:"info"`
+		List []rawCapture          `bencode:"list"`
+		Map  map[string]rawCapture `bencode:"map"`
+	}{}
+	if err := Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		got      rawCapture
+		expected string
+	}{
+		{v.Info, "d1:bi1e1:ai2ee"},
+		{v.List[0], "d1:xi1ee"},
+		{v.Map["k"], "li3ee"},
+	} {
+		off := bytes.Index(data, []byte(c.expected))
+		if string(c.got) != c.expected || &c.got[0] != &data[off] {
+			t.Fatal("unmarshaler was not handed the original bytes", string(c.got))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package bencode
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type (
+	// Mode controls how a Decoder treats input that is not in canonical form.
+	Mode int
+	// SyntaxError describes malformed or non-canonical input and the offset of
+	// the value it was found in.
+	SyntaxError struct {
+		Offset int64
+		Reason string
+	}
+)
+
+const (
+	// ModeDefault accepts unsorted and duplicate dict keys and trailing data.
+	ModeDefault Mode = iota
+	// ModeStrict rejects unsorted and duplicate dict keys, trailing data and
+	// non-canonical integers.
+	ModeStrict
+	// ModeLenient accepts everything ModeStrict rejects but records a warning
+	// for each violation.
+	ModeLenient
+)
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Reason, e.Offset)
+}
+
+func syntaxError(off int64, reason string) *SyntaxError {
+	return &SyntaxError{off, reason}
+}
+
+func (d *Decoder) SetMode(m Mode) { d.mode = m }
+
+// Warnings returns the canonical form violations found in ModeLenient.
+func (d *Decoder) Warnings() []*SyntaxError { return d.warns }
+
+// violation rejects the input in ModeStrict and records a warning in
+// ModeLenient.
+func (d *Decoder) violation(off int64, reason string) error {
+	switch d.mode {
+	case ModeStrict:
+		return syntaxError(off, reason)
+	case ModeLenient:
+		d.warns = append(d.warns, syntaxError(off, reason))
+	}
+	return nil
+}
+
+// number parses the digits in raw, found at off, as a canonical integer. In
+// ModeLenient non-canonical integers such as 03 or -0 are also accepted.
+func (d *Decoder) number(raw []byte, off int64, what string) (int64, error) {
+	i, err := parseInt(raw)
+	if err == nil {
+		return i, nil
+	}
+	if err == ErrIntOverflow {
+		return 0, limitError(err, off)
+	}
+	if d.mode == ModeLenient {
+		if i, lerr := strconv.ParseInt(string(raw), 10, 64); lerr == nil {
+			return i, d.violation(off, "non-canonical "+what+" "+string(raw))
+		}
+	}
+	return 0, syntaxError(off, err.Error())
+}
+
+// checkKey makes sure that dict keys are unique and in sorted order.
+func (d *Decoder) checkKey(k String, off int64) error {
+	top := d.top()
+	if top.elems > 0 {
+		switch {
+		case top.key.Equal(k):
+			if err := d.violation(off, "duplicate dict key "+strconv.Quote(k.Raw())); err != nil {
+				return err
+			}
+		case k.Less(top.key):
+			if err := d.violation(off, "unsorted dict key "+strconv.Quote(k.Raw())); err != nil {
+				return err
+			}
+		}
+	}
+	top.key = k
+	return nil
+}
+
+// Finish checks that there is no data left in the input after the values
+// that have been read.
+func (d *Decoder) Finish() error {
+	if len(d.stack) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if _, err := d.src.ReadByte(); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	d.src.UnreadByte()
+	return d.violation(d.Offset(), "trailing data after value")
+}
+
+func decodeMode(data []byte, m Mode) (Bencoder, []*SyntaxError, error) {
+	dec := newDecoder(&bytesSource{data: data})
+	dec.SetMode(m)
+	v, err := dec.Value()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = dec.Finish()
+	}
+	return v, dec.Warnings(), err
+}
+
+// DecodeStrict decodes data, which must hold exactly one value in canonical
+// form.
+func DecodeStrict(data []byte) (Bencoder, error) {
+	v, _, err := decodeMode(data, ModeStrict)
+	return v, err
+}
+
+// DecodeLenient decodes the first value in data and reports every way in
+// which data is not in canonical form as a warning.
+func DecodeLenient(data []byte) (Bencoder, []*SyntaxError, error) {
+	return decodeMode(data, ModeLenient)
+}
@@ -0,0 +1,70 @@
+package bencode
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeStrict(t *testing.T) {
+	if _, err := DecodeStrict(realWorldData); err != nil {
+		t.Fatal("real world torrent was not canonical", err)
+	}
+	for input, offset := range map[string]int64{
+		"d1:bi1e1:ai2ee":   7,
+		"d1:ai1e1:ai2ee":   7,
+		"ld1:ai1e1:ai2eee": 8,
+		"i03e":             0,
+		"i-0e":             0,
+		"l03:abce":         1,
+		"i1ei2e":           3,
+		"4:spamx":          6,
+		"d1:ai1ei2ei3ee":   7,
+		"x":                0,
+	} {
+		_, err := DecodeStrict([]byte(input))
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Fatal("expected syntax error for", input, "but got", err)
+		}
+		if se.Offset != offset {
+			t.Fatal("syntax error for", input, "had wrong offset", se.Offset, se)
+		}
+	}
+}
+
+func TestDecodeLenient(t *testing.T) {
+	v, warns, err := DecodeLenient([]byte("d1:bi03e1:ai-0e1:al04:spamee3:foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "d1:bi3e1:ai0e1:al4:spamee" {
+		t.Fatal("lenient decode returned the wrong value", v.String())
+	}
+	reasons := make([]string, 0)
+	for _, w := range warns {
+		reasons = append(reasons, w.Reason)
+	}
+	expected := []string{
+		"non-canonical integer 03",
+		"unsorted dict key \"a\"",
+		"non-canonical integer -0",
+		"duplicate dict key \"a\"",
+		"non-canonical string length 04",
+		"trailing data after value",
+	}
+	if strings.Join(reasons, "|") != strings.Join(expected, "|") {
+		t.Fatal("unexpected warnings", reasons)
+	}
+}
+
+func TestDecodeDefaultMode(t *testing.T) {
+	if _, err := DecodeFromString("d1:bi1e1:ai2eetrailing"); err != nil {
+		t.Fatal("default mode should accept unsorted keys and trailing data", err)
+	}
+	_, err := DecodeFromString("i03e")
+	var se *SyntaxError
+	if !errors.As(err, &se) {
+		t.Fatal("default mode should reject non-canonical integers", err)
+	}
+}
@@ -1,6 +1,7 @@
 package bitfield
 
 import (
+	"dht/bencode"
 	"errors"
 	"fmt"
 	"io"
@@ -152,3 +153,40 @@ func (b *BitField) AllUnset() []int {
 func (b *BitField) NumBytes() int { return len(b.pieces) }
 
 func (b *BitField) Bytes() []byte { return b.pieces }
+
+// MarshalBencode writes b as a list of its number of pieces and its bytes,
+// since the bytes alone do not say how many of the padding bits are pieces.
+func (b *BitField) MarshalBencode() ([]byte, error) {
+	return bencode.L(bencode.I(int64(b.numPieces)), bencode.String(b.pieces)).Bytes(), nil
+}
+
+func (b *BitField) UnmarshalBencode(data []byte) error {
+	v, err := bencode.DecodeFromBytes(data)
+	if err != nil {
+		return err
+	}
+	l, ok := v.(bencode.List)
+	if !ok || l.Len() != 2 {
+		return errors.New("bitfield should be a list of its size and its pieces")
+	}
+	n, ok := l[0].(bencode.Int)
+	if !ok {
+		return errors.New("bitfield size was not an Int")
+	}
+	pieces, ok := l[1].(bencode.String)
+	if !ok {
+		return errors.New("bitfield pieces were not a String")
+	}
+	numPieces := int(n.Raw())
+	if numPieces <= 0 {
+		return errors.New("cannot have bitfield of size <= 0")
+	}
+	if int64(numPieces) != n.Raw() || len(pieces) != (numPieces+7)/8 {
+		return errors.New("bitfield size does not match its pieces")
+	}
+	if extra := numPieces % 8; extra != 0 && pieces[len(pieces)-1]&(allOn>>extra) != 0 {
+		return errors.New("bitfield has padding bits set")
+	}
+	b.numPieces, b.pieces = numPieces, pieces.Clone()
+	return nil
+}
@@ -1,6 +1,7 @@
 package bitfield
 
 import (
+	"dht/bencode"
 	"fmt"
 	"testing"
 )
@@ -42,3 +43,51 @@ func TestBitField(t *testing.T) {
 		}
 	}
 }
+
+func TestBitFieldBencode(t *testing.T) {
+	bf := NewBitField(16, false).Set(1).Set(9)
+	data, err := bencode.Marshal(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "li16e2:\x40\x40e" {
+		t.Fatal("bitfield did not marshal as expected", data)
+	}
+	out := &BitField{}
+	if err := bencode.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != bf.String() || !out.IsSet(9) {
+		t.Fatal("bitfield did not survive a round trip", out)
+	}
+}
+
+func TestBitFieldBencodePadding(t *testing.T) {
+	bf := NewBitField(10, false).Set(0).Set(9)
+	data, err := bencode.Marshal(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &BitField{}
+	if err := bencode.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+	unset := out.AllUnset()
+	if len(unset) != 8 || unset[len(unset)-1] != 8 {
+		t.Fatal("padding bits were reported as pieces", unset)
+	}
+	if out.Fill(); len(out.AllSet()) != 10 || out.Next(0) != -1 {
+		t.Fatal("filled bitfield should have exactly 10 pieces", out.AllSet())
+	}
+	for _, input := range []string{
+		"2:\x80\x40",
+		"li10e1:\x80e",
+		"li10e2:\x80\x60e",
+		"li0e0:e",
+		"li10ei1ee",
+	} {
+		if err := bencode.Unmarshal([]byte(input), &BitField{}); err == nil {
+			t.Fatal("invalid bitfield was unmarshalled", input)
+		}
+	}
+}
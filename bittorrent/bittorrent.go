@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"reflect"
 )
 
 type (
@@ -29,20 +30,21 @@ type (
 	Unchoke       struct{}
 	Interested    struct{}
 	NotInterested struct{}
-	// Messages with data
-	Have     struct{ Index uint }
+	// Messages with data. Indices, offsets and lengths are uint32, the size
+	// they have on the wire.
+	Have     struct{ Index uint32 }
 	BitField struct {
 		*bf.BitField
 	}
 	Request struct {
-		Index, Begin, Length uint
+		Index, Begin, Length uint32
 	}
 	Piece struct {
-		Index, Begin uint
+		Index, Begin uint32
 		Piece        []byte
 	}
 	Cancel struct {
-		Index, Begin, Length uint
+		Index, Begin, Length uint32
 	}
 	Port struct{ Port uint16 }
 	// Special Handshake Message
@@ -51,7 +53,12 @@ type (
 		Hash, PeerID []byte
 	}
 	ExtendedHandshake struct {
-		Dict bencode.Dict
+		Dict         bencode.Dict     `bencode:"-"`
+		M            map[string]int64 `bencode:"m"`
+		MetadataSize int64            `bencode:"metadata_size,omitempty"`
+		Port         int64            `bencode:"p,omitempty"`
+		Version      string           `bencode:"v,omitempty"`
+		ReqQ         int64            `bencode:"reqq,omitempty"`
 	}
 )
 
@@ -76,6 +83,7 @@ const (
 	DHT            extension = 2
 	Extended       extension = 20
 	DHTAndExtended extension = 22
+	hashSize                 = 20
 )
 
 var (
@@ -96,7 +104,7 @@ func (Cancel) Kind() byte            { return cancel }
 func (Port) Kind() byte              { return port }
 func (ExtendedHandshake) Kind() byte { return extended }
 
-func (KeepAlive) Write(w *streamer) error { return w.WriteNumbers(uint(0)) }
+func (KeepAlive) Write(w *streamer) error { return w.WriteNumbers(uint32(0)) }
 func (h Handshake) Write(w *streamer) error {
 	if err := w.Write(19); err != nil {
 		return err
@@ -115,37 +123,39 @@ func (h Handshake) Write(w *streamer) error {
 	}
 	return nil
 }
-func (Choke) Write(w *streamer) error         { return w.WriteNumbers(uint(1), choke) }
-func (Unchoke) Write(w *streamer) error       { return w.WriteNumbers(uint(1), unchoke) }
-func (Interested) Write(w *streamer) error    { return w.WriteNumbers(uint(1), interested) }
-func (NotInterested) Write(w *streamer) error { return w.WriteNumbers(uint(1), notInterested) }
-func (h Have) Write(w *streamer) error        { return w.WriteNumbers(uint(5), have, h.Index) }
+func (Choke) Write(w *streamer) error         { return w.WriteNumbers(uint32(1), choke) }
+func (Unchoke) Write(w *streamer) error       { return w.WriteNumbers(uint32(1), unchoke) }
+func (Interested) Write(w *streamer) error    { return w.WriteNumbers(uint32(1), interested) }
+func (NotInterested) Write(w *streamer) error { return w.WriteNumbers(uint32(1), notInterested) }
+func (h Have) Write(w *streamer) error        { return w.WriteNumbers(uint32(5), have, h.Index) }
 func (b BitField) Write(w *streamer) error {
-	if err := w.WriteNumbers(uint(b.NumBytes()), bitfield); err != nil {
+	if err := w.WriteNumbers(uint32(b.NumBytes()+1), bitfield); err != nil {
 		return err
 	}
 	return w.Write(b.Bytes()...)
 }
 func (r Request) Write(w *streamer) error {
-	return w.WriteNumbers(uint(13), request, r.Index, r.Begin, r.Length)
+	return w.WriteNumbers(uint32(13), request, r.Index, r.Begin, r.Length)
 }
 func (p Piece) Write(w *streamer) error {
-	if err := w.WriteNumbers(uint(len(p.Piece)+9), piece, p.Index, p.Begin); err != nil {
+	if err := w.WriteNumbers(uint32(len(p.Piece)+9), piece, p.Index, p.Begin); err != nil {
 		return err
 	}
 	return w.Write(p.Piece...)
 }
 func (c Cancel) Write(w *streamer) error {
-	return w.WriteNumbers(uint(13), cancel, c.Index, c.Begin, c.Length)
+	return w.WriteNumbers(uint32(13), cancel, c.Index, c.Begin, c.Length)
 }
-func (p Port) Write(w *streamer) error { return w.WriteNumbers(uint(3), port, p.Port) }
+func (p Port) Write(w *streamer) error { return w.WriteNumbers(uint32(3), port, p.Port) }
 func (e ExtendedHandshake) Write(w *streamer) error {
-	hsMetadata := bencode.D(
-		bencode.P(bencode.S("m"), bencode.D(
-			bencode.P(bencode.S("ut_metadata"), bencode.I(1)),
-		)),
-	).Bytes()
-	return w.WriteNumbers(2+uint(len(hsMetadata)), Extended, blank, hsMetadata)
+	if e.M == nil {
+		e.M = map[string]int64{"ut_metadata": 1}
+	}
+	hsMetadata, err := bencode.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return w.WriteNumbers(2+uint32(len(hsMetadata)), extended, blank, hsMetadata)
 }
 
 func newStreamer(rw io.ReadWriter, maxSize int) *streamer {
@@ -233,21 +243,36 @@ func NewWire(rw io.ReadWriter, maxSize int) *Wire {
 	return &Wire{newStreamer(rw, maxSize)}
 }
 
+// fixedLengths are the lengths of the messages whose size never changes.
+var fixedLengths = map[byte]uint32{
+	choke:         1,
+	unchoke:       1,
+	interested:    1,
+	notInterested: 1,
+	have:          5,
+	request:       13,
+	cancel:        13,
+	port:          3,
+}
+
 func (w *Wire) ReadMessage() (Message, error) {
-	length := uint(0)
+	length := uint32(0)
 	if err := w.ReadNumber(&length); err != nil {
 		return nil, err
 	}
 	if length == 0 {
 		return KeepAlive{}, nil
 	}
-	if length > uint(w.max) {
+	if length > uint32(w.max) {
 		return nil, errors.New("message is too large")
 	}
 	hdr, err := w.ReadByte()
 	if err != nil {
 		return nil, err
 	}
+	if fixed, ok := fixedLengths[hdr]; ok && fixed != length {
+		return nil, errors.New("message has the wrong length for its type")
+	}
 	switch hdr {
 	case choke:
 		return Choke{}, nil
@@ -282,13 +307,19 @@ func (w *Wire) ReadMessage() (Message, error) {
 		}
 		return pm, nil
 	case bitfield:
-		bf, err := bf.BitFieldFromReader(w.ReadWriter, int(length)*8)
+		if length < 2 {
+			return nil, errors.New("bitfield message is empty")
+		}
+		bf, err := bf.BitFieldFromReader(w.ReadWriter, int(length-1)*8)
 		if err != nil {
 			return nil, err
 		}
 		return BitField{bf}, nil
 	case piece:
-		pm := Piece{0, 0, make([]byte, length)}
+		if length < 9 {
+			return nil, errors.New("piece message is too short")
+		}
+		pm := Piece{0, 0, make([]byte, length-9)}
 		if err := w.ReadNumbers(&pm.Index, &pm.Begin); err != nil {
 			return nil, err
 		}
@@ -296,6 +327,8 @@ func (w *Wire) ReadMessage() (Message, error) {
 			return nil, err
 		}
 		return pm, nil
+	case extended:
+		return w.readExtendedHandshake(length)
 	}
 	return nil, errors.New("could not recognize message header")
 }
@@ -336,14 +369,18 @@ func (w *Wire) ReceiveHandshake() (h Handshake, err error) {
 	if h.Extension == Unknown {
 		return h, errors.New("unrecognized reserved byte section")
 	}
+	h.Hash, h.PeerID = make([]byte, hashSize), make([]byte, hashSize)
 	return h, w.ReadRaws(h.Hash, h.PeerID)
 }
 
 func (w *Wire) ReceiveExtendedHandshake() (eh ExtendedHandshake, err error) {
-	l := uint(0)
+	l := uint32(0)
 	if err := w.ReadNumber(&l); err != nil {
 		return eh, err
 	}
+	if l > uint32(w.max) {
+		return eh, errors.New("message is too large")
+	}
 	ext, err := w.ReadByte()
 	if err != nil {
 		return eh, err
@@ -351,6 +388,15 @@ func (w *Wire) ReceiveExtendedHandshake() (eh ExtendedHandshake, err error) {
 	if ext != extended {
 		return eh, errors.New("peer did not respond with extension handshake")
 	}
+	return w.readExtendedHandshake(l)
+}
+
+// readExtendedHandshake reads the rest of an extended message of length l
+// after its message id.
+func (w *Wire) readExtendedHandshake(l uint32) (eh ExtendedHandshake, err error) {
+	if l < 2 {
+		return eh, errors.New("extended message is too short")
+	}
 	h, err := w.ReadByte()
 	if err != nil {
 		return eh, err
@@ -370,6 +416,9 @@ func (w *Wire) ReceiveExtendedHandshake() (eh ExtendedHandshake, err error) {
 	if !ok {
 		return eh, errors.New("message was not a dict but should have been")
 	}
+	if err := di.Unmarshal(reflect.ValueOf(&eh)); err != nil {
+		return eh, err
+	}
 	eh.Dict = di
 	return eh, nil
 }
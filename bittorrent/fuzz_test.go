@@ -0,0 +1,77 @@
+package bittorrent
+
+import (
+	"bytes"
+	bf "dht/bitfield"
+	"reflect"
+	"testing"
+)
+
+const fuzzMaxSize = 1 << 16
+
+func encodeMessages(f *testing.F, ms ...Message) []byte {
+	buf := &bytes.Buffer{}
+	w := NewWire(buf, fuzzMaxSize)
+	for _, m := range ms {
+		if err := w.Send(m); err != nil {
+			f.Fatal("could not encode seed message", m, err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func FuzzReadMessage(f *testing.F) {
+	field := bf.NewBitField(16, false)
+	field.Set(3)
+	messages := []Message{
+		KeepAlive{}, Choke{}, Unchoke{}, Interested{}, NotInterested{},
+		Have{7}, BitField{field}, Request{1, 2, 3}, Piece{1, 2, []byte("piece")},
+		Cancel{1, 2, 3}, Port{6881}, ExtendedHandshake{MetadataSize: 1024, Version: "dht"},
+	}
+	for _, m := range messages {
+		f.Add(encodeMessages(f, m))
+	}
+	f.Add(encodeMessages(f, messages...))
+	f.Add([]byte{0, 0, 0, 1})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		w := NewWire(bytes.NewBuffer(data), fuzzMaxSize)
+		for i := 0; i < len(data); i++ {
+			m, err := w.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, ok := m.(ExtendedHandshake); ok {
+				// unknown keys in the dict are not written back out
+				continue
+			}
+			buf := &bytes.Buffer{}
+			again := NewWire(buf, fuzzMaxSize)
+			if err := again.Send(m); err != nil {
+				t.Fatal("could not write message that was read", m, err)
+			}
+			back, err := again.ReadMessage()
+			if err != nil || !reflect.DeepEqual(m, back) {
+				t.Fatal("message did not survive a round trip", m, back, err)
+			}
+		}
+	})
+}
+
+func FuzzReceiveHandshake(f *testing.F) {
+	hash, peer := bytes.Repeat([]byte{1}, hashSize), bytes.Repeat([]byte{2}, hashSize)
+	f.Add(encodeMessages(f, Handshake{DHT, hash, peer}))
+	f.Add(encodeMessages(f, Handshake{DHT, hash, peer}, ExtendedHandshake{}))
+	f.Add([]byte{19})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		w := NewWire(bytes.NewBuffer(data), fuzzMaxSize)
+		h, err := w.ReceiveHandshake()
+		if err != nil {
+			return
+		}
+		if len(h.Hash) != hashSize || len(h.PeerID) != hashSize {
+			t.Fatal("handshake had the wrong size hash or peer id", h)
+		}
+		w.ReceiveExtendedHandshake()
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"dht/bencode"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `usage: bencode <command> [flags] [file]
+
+Reads from file, or from stdin when no file is given.
+
+commands:
+    decode              print bencoded input as JSON
+    encode              bencode JSON input produced by decode
+    validate            check that input is a single value in canonical form
+    get <path>          print the value at path, e.g. info.files[0].path or
+                        info.files[*].length
+    infohash            print the infohash of a torrent file
+`
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func input(fs *flag.FlagSet) []byte {
+	var (
+		data []byte
+		err  error
+	)
+	switch fs.NArg() {
+	case 0:
+		data, err = io.ReadAll(os.Stdin)
+	case 1:
+		data, err = os.ReadFile(fs.Arg(0))
+	default:
+		err = errors.New("too many arguments")
+	}
+	if err != nil {
+		fail(err)
+	}
+	return data
+}
+
+func decodeInput(fs *flag.FlagSet) bencode.Bencoder {
+	// integers of any size are valid bencode so do not limit them to an int64
+	dec := bencode.NewBytesDecoder(input(fs))
+	dec.UseBigInts(true)
+	v, err := dec.Value()
+	if err == io.EOF {
+		fail(errors.New("input is empty"))
+	}
+	if err != nil {
+		fail(err)
+	}
+	return v
+}
+
+func printJSON(v bencode.Bencoder, compact, base64 bool) {
+	opts := bencode.JSONOptions{Indent: "    "}
+	if compact {
+		opts.Indent = ""
+	}
+	if base64 {
+		opts.Binary = bencode.BinaryBase64
+	}
+	data, err := bencode.ToJSON(v, opts)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(string(data))
+}
+
+func decode(args []string) {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	compact := fs.Bool("compact", false, "print JSON on a single line")
+	base64 := fs.Bool("base64", false, "write binary strings as base64 instead of hex")
+	pretty := fs.Bool("pretty", false, "print with Pretty instead of as JSON")
+	fs.Parse(args)
+	v := decodeInput(fs)
+	if *pretty {
+		fmt.Print(v.Pretty("", "    "))
+		return
+	}
+	printJSON(v, *compact, *base64)
+}
+
+func encode(args []string) {
+	fs := flag.NewFlagSet("encode", flag.ExitOnError)
+	fs.Parse(args)
+	v, err := bencode.FromJSON(input(fs))
+	if err != nil {
+		fail(err)
+	}
+	if _, err := os.Stdout.Write(v.Bytes()); err != nil {
+		fail(err)
+	}
+}
+
+func validate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+	// accept the same integers as decode
+	dec := bencode.NewBytesDecoder(input(fs))
+	dec.SetMode(bencode.ModeLenient)
+	dec.UseBigInts(true)
+	_, err := dec.Value()
+	if err == io.EOF {
+		fail(errors.New("input is empty"))
+	}
+	if err == nil {
+		err = dec.Finish()
+	}
+	if err != nil {
+		fail(err)
+	}
+	warns := dec.Warnings()
+	for _, w := range warns {
+		fmt.Println(w)
+	}
+	if len(warns) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func get(args []string) {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	compact := fs.Bool("compact", false, "print JSON on a single line")
+	raw := fs.Bool("raw", false, "print the bencoding of the value instead of JSON")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fail(errors.New("get requires a path"))
+	}
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	wild, err := bencode.HasWildcard(path)
+	if err != nil {
+		fail(err)
+	}
+	var v bencode.Bencoder
+	if wild {
+		// wildcards can match any number of values so print those as a list
+		var res bencode.Results
+		res, err = bencode.Query(decodeInput(fs), path)
+		v = bencode.L(res...)
+	} else {
+		v, err = bencode.Lookup(decodeInput(fs), path)
+	}
+	if err != nil {
+		fail(err)
+	}
+	if *raw {
+		os.Stdout.Write(v.Bytes())
+		return
+	}
+	printJSON(v, *compact, false)
+}
+
+func infohash(args []string) {
+	fs := flag.NewFlagSet("infohash", flag.ExitOnError)
+	v2 := fs.Bool("v2", false, "print the SHA-256 infohash of a BitTorrent v2 torrent")
+	fs.Parse(args)
+	data := input(fs)
+	v, span, err := bencode.DecodeWithSpans(data)
+	if err != nil {
+		fail(err)
+	}
+	d, ok := v.(bencode.Dict)
+	if !ok {
+		fail(errors.New("torrent is not a dict"))
+	}
+	infoSpan, ok := span.Key(d, bencode.S("info"))
+	if !ok {
+		fail(errors.New("torrent has no info dict"))
+	}
+	info := infoSpan.Bytes(data)
+	if *v2 {
+		hash := sha256.Sum256(info)
+		fmt.Println(hex.EncodeToString(hash[:]))
+	} else {
+		hash := sha1.Sum(info)
+		fmt.Println(hex.EncodeToString(hash[:]))
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "decode":
+		decode(args)
+	case "encode":
+		encode(args)
+	case "validate":
+		validate(args)
+	case "get":
+		get(args)
+	case "infohash":
+		infohash(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const fixture = "../../bencode/ubuntu-21.04-desktop-amd64.iso.torrent"
+
+// TestMain runs the command instead of the tests when the test binary is
+// started by run.
+func TestMain(m *testing.M) {
+	if os.Getenv("BENCODE_CLI") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and stdin, returning what it printed to
+// stdout and its exit code.
+func run(t *testing.T, stdin []byte, args ...string) (string, int) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "BENCODE_CLI=1")
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return string(out), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+func TestDecodeEncode(t *testing.T) {
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, code := run(t, nil, "decode", "-compact", fixture)
+	if code != 0 || !strings.HasPrefix(out, `{"announce":"https://torrent.ubuntu.com/announce",`) {
+		t.Fatal("unexpected decode output", code, out)
+	}
+	back, code := run(t, []byte(out), "encode")
+	if code != 0 || back != string(data) {
+		t.Fatal("torrent did not survive decode and encode", code)
+	}
+	if out, code = run(t, []byte(`{"b":1,"a":2}`), "encode"); code != 0 || out != "d1:ai2e1:bi1ee" {
+		t.Fatal("unexpected encode output", code, out)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if out, code := run(t, nil, "validate", fixture); code != 0 || out != "ok\n" {
+		t.Fatal("fixture should be valid", code, out)
+	}
+	if _, code := run(t, []byte("d1:bi1e1:ai2ee"), "validate"); code != 1 {
+		t.Fatal("unsorted dict should not be valid", code)
+	}
+	big := []byte("i12345678901234567890e")
+	if out, code := run(t, big, "validate"); code != 0 || out != "ok\n" {
+		t.Fatal("integer larger than an int64 should be valid", code, out)
+	}
+	if out, code := run(t, big, "decode"); code != 0 || out != "12345678901234567890\n" {
+		t.Fatal("integer larger than an int64 should decode", code, out)
+	}
+}
+
+func TestGet(t *testing.T) {
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"get", "-compact", "announce-list[*][0]", fixture}, `["https://torrent.ubuntu.com/announce","https://ipv6.torrent.ubuntu.com/announce"]` + "\n"},
+		{[]string{"get", "info.piece length", fixture}, "262144\n"},
+		{[]string{"get", "-raw", "info.name", fixture}, "30:ubuntu-21.04-desktop-amd64.iso"},
+	} {
+		if out, code := run(t, nil, c.args...); code != 0 || out != c.expected {
+			t.Fatal("unexpected get output for", c.args, code, out)
+		}
+	}
+	// an escaped * is a key, so it matches a single value and not a list
+	if out, code := run(t, []byte("d1:*i1ee"), "get", `\*`); code != 0 || out != "1\n" {
+		t.Fatal("escaped * should get a single value", code, out)
+	}
+	if _, code := run(t, nil, "get", `info.\*`, fixture); code != 1 {
+		t.Fatal("missing key should fail", code)
+	}
+}
+
+func TestInfohash(t *testing.T) {
+	if out, code := run(t, nil, "infohash", fixture); code != 0 || out != "64a980abe6e448226bb930ba061592e44c3781a1\n" {
+		t.Fatal("unexpected infohash", code, out)
+	}
+	if out, code := run(t, nil, "infohash", "-v2", fixture); code != 0 || len(out) != 65 {
+		t.Fatal("unexpected v2 infohash", code, out)
+	}
+}
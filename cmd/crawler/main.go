@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"dht"
-	"dht/bencode"
 	"dht/crawler"
 	"log"
 	"net"
@@ -12,11 +10,12 @@ import (
 )
 
 const (
-	addr             = "0.0.0.0"
+	addr             = "::"
 	port             = 6881
 	bufferSize       = 2 << 18
 	messageQueueSize = 2 << 12
-	network          = "udp4"
+	// network is dual-stack so the crawler reaches both IPv4 and IPv6 nodes
+	network = "udp"
 )
 
 func createUDPConn() (*net.UDPConn, error) {
@@ -32,7 +31,7 @@ func createCrawler(conn *net.UDPConn) (crawler.Crawler, error) {
 	if err != nil {
 		return nil, err
 	}
-	return crawler.New(port, dht.NewUDPSender(messageQueueSize, conn), dht.NewDownloader(), id), nil
+	return crawler.New(port, dht.NewUDPSender(messageQueueSize, conn), dht.NewDownloader(), id)
 }
 
 func startMessageHandler(c crawler.Crawler, conn *net.UDPConn) (dht.MessageHandler, error) {
@@ -43,10 +42,7 @@ func startMessageHandler(c crawler.Crawler, conn *net.UDPConn) (dht.MessageHandl
 	if err := mh.RegisterHandler(dht.QueryType, c.HandleQuery); err != nil {
 		return nil, err
 	}
-	if err := mh.RegisterHandler(dht.ErrorType, func(r dht.Requester, d bencode.Dict) error {
-		log.Println(d.Pretty("", "    "))
-		return nil
-	}); err != nil {
+	if err := mh.RegisterHandler(dht.ErrorType, c.HandleResponse); err != nil {
 		return nil, err
 	}
 	go func() {
@@ -54,9 +50,9 @@ func startMessageHandler(c crawler.Crawler, conn *net.UDPConn) (dht.MessageHandl
 		for {
 			n, r, err := conn.ReadFromUDP(buf)
 			if err == nil {
-				if err := mh.Handle(
+				if err := mh.HandleBytes(
 					dht.UDPRequester{UDPAddr: r},
-					bytes.NewReader(buf[:n]),
+					buf[:n],
 				); err != nil {
 					log.Println("While handling request:", err)
 				}
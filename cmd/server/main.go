@@ -40,7 +40,7 @@ func mustInt(s string) int {
 
 func serveUDP(address, port, message string) {
 	buf := make([]byte, 16)
-	l, err := net.ListenUDP("udp", &net.UDPAddr{net.ParseIP(address), mustInt(port), ""})
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(address), Port: mustInt(port), Zone: ""})
 	if err != nil {
 		log.Println(err)
 		return
@@ -1,55 +1,43 @@
 package crawler
 
 import (
+	"context"
 	"dht"
 	b "dht/bencode"
 	"dht/bittorrent"
 	"errors"
 	"log"
 	"net"
-	"reflect"
+	"sync"
 	"time"
 )
 
 type (
 	Crawler interface {
+		// HandleResponse handles both responses and errors sent in reply to
+		// the crawler's queries.
 		HandleResponse(dht.Requester, b.Dict) error
 		HandleQuery(dht.Requester, b.Dict) error
 		Start([]dht.Node) error
 	}
-	getMessage struct {
-		Args struct {
-			ID   b.String
-			Hash string
-		}
-		Query         string
-		TransactionID b.String
-		MessageType   string
-	}
-	announceMessage struct {
-		Args struct {
-			ID          b.String
-			ImpliedPort uint64
-			Hash        b.String
-			Port        uint64
-			Token       b.String
-		}
-		Query         string
-		TransactionID b.String
-		MessageType   string
-	}
 	crawler struct {
 		port       uint16
 		sender     dht.Sender
 		downloader dht.MetaLoader
 		clientID   b.String
-		// TODO: better data structure for nodes
+		// server answers the queries that are not crawled like any other node
+		server *dht.Server
+		tokens *dht.TokenManager
+		mu     sync.Mutex
+		// nodes are candidates that have not responded to us yet, nodes that
+		// have are kept in the routing table of server
 		nodes []dht.Node
 	}
 )
 
 const (
-	tokenLength = 2
+	// maxCandidates bounds the nodes queried on each tick
+	maxCandidates = 1 << 10
 )
 
 func repeat(d time.Duration, f func()) {
@@ -60,131 +48,134 @@ func repeat(d time.Duration, f func()) {
 	}
 }
 
-func New(port uint16, sender dht.Sender, downloader dht.MetaLoader, clientID b.String) Crawler {
-	return &crawler{port, sender, downloader, clientID, make([]dht.Node, 0)}
-}
-
-func (c *crawler) HandleResponse(req dht.Requester, d b.Dict) error {
-	resp, err := d.GetDict(dht.ResponseKey)
+func New(port uint16, sender dht.Sender, downloader dht.MetaLoader, clientID b.String) (Crawler, error) {
+	server, err := dht.NewDualStackServer(clientID, sender)
 	if err != nil {
-		return err
-	}
-	nodesStr, err := resp.GetString(dht.ResponseNodes)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	nodes, err := dht.ParseNodes(nodesStr)
+	tokens, err := dht.NewTokenManager(nil)
 	if err != nil {
-		return err
-	}
+		return nil, err
+	}
+	return &crawler{
+		port:       port,
+		sender:     sender,
+		downloader: downloader,
+		clientID:   clientID,
+		server:     server,
+		tokens:     tokens,
+		nodes:      make([]dht.Node, 0),
+	}, nil
+}
+
+func (c *crawler) HandleResponse(req dht.Requester, d b.Dict) error {
+	return c.server.HandleResponse(req, d)
+}
+
+func (c *crawler) addNodes(nodes dht.Nodes) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, node := range nodes {
+		if len(c.nodes) >= maxCandidates {
+			break
+		}
 		if node.Valid(c.clientID) {
 			c.nodes = append(c.nodes, node)
 		}
 	}
-	return nil
 }
 
 func (c *crawler) handleGet(req dht.Requester, d b.Dict) error {
-	r := &getMessage{}
-	if err := d.Unmarshal(reflect.ValueOf(r)); err != nil {
-		return err
-	}
-	hash, id := r.Args.Hash, r.Args.ID
-	if len(hash) != dht.BytesInID || len(id) != dht.BytesInID {
-		return errors.New("hash or id have incorrect length")
+	q := dht.GetPeersQuery{}
+	if err := q.Decode(d); err != nil {
+		return dht.NewKRPCError(dht.ErrorProtocol, err.Error())
 	}
-	token := hash[:tokenLength]
 	c.sender.Send(dht.Message{
-		Data: b.D(
-			b.P(dht.ResponseKey, b.D(
-				b.P(dht.IDKey, dht.NeighborID(b.S(hash), id)),
-				b.P(dht.ResponseNodes, dht.Empty),
-				b.P(dht.TokenKey, b.S(token)),
-			)),
-			b.P(dht.TransactionID, r.TransactionID),
-			b.P(dht.MessageType, dht.ResponseType),
-		),
+		Data: dht.GetPeersResponse{
+			TransactionID: q.TransactionID.Clone(),
+			ID:            dht.NeighborID(q.InfoHash, q.ID),
+			Token:         c.tokens.Token(dht.RequesterIP(req)),
+			Nodes:         dht.Nodes{},
+		}.Encode(),
 		Requester: req,
 	})
 	return nil
 }
 
 func (c *crawler) handleAnnounce(req dht.Requester, d b.Dict) error {
-	r := &announceMessage{}
-	if err := d.Unmarshal(reflect.ValueOf(r)); err != nil {
-		return err
-	}
-	port := r.Args.Port
-	if r.Args.ImpliedPort != 0 {
-		port = uint64(req.Port())
+	q := dht.AnnouncePeerQuery{}
+	if err := q.Decode(d); err != nil {
+		return dht.NewKRPCError(dht.ErrorProtocol, err.Error())
 	}
-	hash := r.Args.Hash
-	if !hash[:tokenLength].Equal(r.Args.Token) {
-		return errors.New("invalid token in announce request")
-	} else if port >= dht.MaxPort {
-		return errors.New("port is invalid")
+	if !c.tokens.Valid(dht.RequesterIP(req), q.Token) {
+		return dht.NewKRPCError(dht.ErrorProtocol, "invalid token in announce request")
 	}
 	c.sender.Send(dht.Message{
-		Data: b.D(
-			b.P(dht.ResponseKey, b.D(
-				b.P(dht.IDKey, dht.NeighborID(hash, r.Args.ID)),
-			)),
-			b.P(dht.TransactionID, r.TransactionID),
-			b.P(dht.MessageType, dht.ResponseKey),
-		),
+		Data: dht.AnnouncePeerResponse{
+			TransactionID: q.TransactionID.Clone(),
+			ID:            dht.NeighborID(q.InfoHash, q.ID),
+		}.Encode(),
 		Requester: req,
 	})
 	c.downloader.Load(dht.TorrentHash{
-		Hash:      r.Args.Hash,
+		Hash:      q.InfoHash.Clone(),
 		Requester: req,
 	})
 	return nil
 }
 
+// HandleQuery answers get_peers and announce_peer queries so that the
+// crawler hears about as many infohashes as possible, every other query is
+// answered by a regular dht.Server. When the query cannot be answered a KRPC
+// error is sent instead, queries without a transaction id are dropped since no
+// reply to them could be matched up.
 func (c *crawler) HandleQuery(req dht.Requester, d b.Dict) error {
-	query, err := d.GetString(dht.QueryKey)
-	if err != nil {
-		return err
-	}
+	query, _ := d.GetString(dht.QueryKey)
+	var handle dht.Handler
 	switch {
 	case dht.QueryGet.Equal(query):
-		return c.handleGet(req, d)
+		handle = c.handleGet
 	case dht.QueryAnnounce.Equal(query):
-		return c.handleAnnounce(req, d)
+		handle = c.handleAnnounce
+	default:
+		return c.server.HandleQuery(req, d)
+	}
+	t, err := d.GetString(dht.TransactionID)
+	if err != nil {
+		return err
 	}
-	return errors.New("cannot handle query type: " + query.Raw())
+	if err := handle(req, d); err != nil {
+		dht.SendError(c.sender, req, t, err)
+		return err
+	}
+	return nil
 }
 
 func (c *crawler) sendFindRequest(node dht.Node) {
-	token, err := dht.RandID()
-	if err != nil {
-		log.Println("Could not get new token for find request", err)
-		return
-	}
 	target, err := dht.RandID()
 	if err != nil {
 		log.Println("Could not get new target ID for find request", err)
 		return
 	}
-	c.sender.Send(dht.Message{
-		Data: b.D(
-			b.P(dht.QueryArgs, b.D(
-				b.P(dht.IDKey, c.clientID),
-				b.P(dht.TargetKey, b.String(target)),
-			)),
-			b.P(dht.QueryKey, dht.QueryFind),
-			b.P(dht.TransactionID, b.String(token[:tokenLength])),
-			b.P(dht.MessageType, dht.QueryType),
-		),
-		Requester: node,
-	})
+	go func() {
+		nodes, err := c.server.FindNode(context.Background(), node, target)
+		if err != nil {
+			log.Println("While finding nodes from", node.Addr(), err)
+			return
+		}
+		c.addNodes(nodes)
+	}()
 }
 
 func (c *crawler) makeNeighbors(bootstrapNodes []dht.Node) {
 	repeat(time.Second, func() {
+		c.mu.Lock()
 		nodes := c.nodes
-		c.nodes = append([]dht.Node{}, bootstrapNodes...)
+		c.nodes = make([]dht.Node, 0)
+		c.mu.Unlock()
+		if len(nodes) == 0 {
+			nodes = c.neighbors(bootstrapNodes)
+		}
 		for _, node := range nodes {
 			if !node.Valid(c.clientID) {
 				log.Println("Skipping make neighbor for:", node)
@@ -195,8 +186,22 @@ func (c *crawler) makeNeighbors(bootstrapNodes []dht.Node) {
 	})
 }
 
+// neighbors returns the nodes closest to a random id from the routing table,
+// or the bootstrap nodes while the table is empty.
+func (c *crawler) neighbors(bootstrapNodes []dht.Node) []dht.Node {
+	target, err := dht.RandID()
+	if err != nil {
+		return bootstrapNodes
+	}
+	if nodes := c.server.Table().Closest(target, dht.K); len(nodes) > 0 {
+		return nodes
+	}
+	return bootstrapNodes
+}
+
 func (c *crawler) Start(bootstrapNodes []dht.Node) error {
 	go c.makeNeighbors(bootstrapNodes)
+	c.server.Start(context.Background(), bootstrapNodes)
 	return nil
 }
 
@@ -205,7 +210,7 @@ func (c *crawler) getMetaData(hash []byte, r dht.Requester) error {
 	// bittorrent handshake
 	// accept extended handshake with port information from peer
 	// ping port on peer
-	conn, err := net.Dial("tcp4", r.Addr().String())
+	conn, err := net.Dial("tcp", r.Addr().String())
 	if err != nil {
 		return err
 	}
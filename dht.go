@@ -28,6 +28,7 @@ type (
 		net.IP
 		port uint16
 	}
+	Nodes   []Node
 	Message struct {
 		Data      b.Dict
 		Requester Requester
@@ -56,12 +57,10 @@ const (
 	bitsInByte         = 8
 	BytesInID          = 20
 	halfBytesInID      = BytesInID / 2
-	compressedNodeSize = 26
-	ipEnd              = BytesInID + 4
-)
-
-var (
-	zeroIP net.IP = net.IP{0, 0, 0, 0}
+	portSize           = 2
+	compressedNodeSize = BytesInID + net.IPv4len + portSize
+	// compressedNode6Size is the size of a node in nodes6, see BEP 32.
+	compressedNode6Size = BytesInID + net.IPv6len + portSize
 )
 
 func RandID() ([]byte, error) {
@@ -90,6 +89,18 @@ func (ur UDPRequester) Addr() net.Addr { return ur.UDPAddr }
 func (tr TCPRequester) Port() int      { return tr.TCPAddr.Port }
 func (tr TCPRequester) Addr() net.Addr { return tr.TCPAddr }
 
+// RequesterIP returns the ip of req, or nil when it is not a UDP or TCP
+// address.
+func RequesterIP(req Requester) net.IP {
+	switch addr := req.Addr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
 func ResolveNode(network, address string, port int) (Node, error) {
 	ret := Node{}
 	addr, err := net.ResolveUDPAddr(network, address+":"+fmt.Sprint(port))
@@ -107,7 +118,10 @@ func ResolveNode(network, address string, port int) (Node, error) {
 	return ret, nil
 }
 
+// ParseNode parses a compact node, either an IPv4 node from nodes or an IPv6
+// node from nodes6 depending on the length of data.
 func ParseNode(data []byte) Node {
+	ipEnd := len(data) - portSize
 	id, address, port := data[:BytesInID], data[BytesInID:ipEnd], data[ipEnd:]
 	return Node{
 		id,
@@ -117,29 +131,80 @@ func ParseNode(data []byte) Node {
 }
 
 func (n Node) Valid(id b.String) bool {
-	return !net.IP.Equal(n.IP, zeroIP) && !bytes.Equal(n.ID, id)
+	return n.IP != nil && !n.IP.IsUnspecified() && !bytes.Equal(n.ID, id)
+}
+
+// IPv6 reports whether n belongs in nodes6 rather than nodes.
+func (n Node) IPv6() bool { return isIPv6(n.IP) }
+
+func isIPv6(ip net.IP) bool { return ip.To4() == nil && len(ip) == net.IPv6len }
+
+// compactIP returns the 4 byte form of an IPv4 address and the 16 byte form of
+// any other.
+func compactIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
 }
 
 func (n Node) String() string {
 	portBytes := []byte{0, 0}
 	binary.BigEndian.PutUint16(portBytes, n.port)
-	return fmt.Sprintf("%s%s%s", n.ID, []byte(n.IP), portBytes)
+	return fmt.Sprintf("%s%s%s", n.ID, compactIP(n.IP), portBytes)
+}
+
+func (n Node) MarshalBencode() ([]byte, error) { return b.S(n.String()).Bytes(), nil }
+
+func (n *Node) UnmarshalBencode(data []byte) error {
+	var raw []byte
+	if err := b.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) != compressedNodeSize && len(raw) != compressedNode6Size {
+		return errors.New("compact node string was invalid, wrong size")
+	}
+	*n = ParseNode(raw)
+	return nil
 }
 
 func (n Node) Port() int      { return int(n.port) }
 func (n Node) Addr() net.Addr { return &net.UDPAddr{IP: n.IP, Port: int(n.port), Zone: ""} }
 
-func ParseNodes(data []byte) ([]Node, error) {
-	if len(data)%compressedNodeSize != 0 {
+// ParseNodes parses the IPv4 nodes found in the nodes key of a response.
+func ParseNodes(data []byte) ([]Node, error) { return parseNodes(data, compressedNodeSize) }
+
+// ParseNodes6 parses the IPv6 nodes found in the nodes6 key of a response.
+func ParseNodes6(data []byte) ([]Node, error) { return parseNodes(data, compressedNode6Size) }
+
+func parseNodes(data []byte, size int) ([]Node, error) {
+	if len(data)%size != 0 {
 		return nil, errors.New("compact nodes string was invalid, wrong size")
 	}
-	nodes := make([]Node, 0, len(data)/compressedNodeSize)
-	for i := 0; i < len(data)-compressedNodeSize; i += compressedNodeSize {
-		nodes = append(nodes, ParseNode(data[i:i+compressedNodeSize]))
+	nodes := make([]Node, 0, len(data)/size)
+	for i := 0; i+size <= len(data); i += size {
+		nodes = append(nodes, ParseNode(data[i:i+size]))
 	}
 	return nodes, nil
 }
 
+// MarshalBencode writes the compact form of the IPv4 nodes in ns, which is
+// what the nodes key holds.
+func (ns Nodes) MarshalBencode() ([]byte, error) { return ns.compact(false).Bytes(), nil }
+
+func (ns *Nodes) UnmarshalBencode(data []byte) error {
+	var raw []byte
+	if err := b.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	nodes, err := ParseNodes(raw)
+	if err != nil {
+		return err
+	}
+	*ns = nodes
+	return nil
+}
+
 func NewUDPSender(queueSize int, conn *net.UDPConn) *udpSender {
 	ret := &udpSender{
 		make(chan Message, queueSize),
@@ -152,9 +217,12 @@ func NewUDPSender(queueSize int, conn *net.UDPConn) *udpSender {
 func (s *udpSender) send() {
 	for {
 		m := <-s.q
-		if _, err := s.conn.WriteTo(m.Data.Bytes(), m.Requester.Addr()); err != nil {
+		buf := b.AcquireBuffer()
+		*buf = m.Data.AppendBencode(*buf)
+		if _, err := s.conn.WriteTo(*buf, m.Requester.Addr()); err != nil {
 			log.Println("While writing to udpconn:", err)
 		}
+		b.ReleaseBuffer(buf)
 	}
 }
 
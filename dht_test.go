@@ -3,7 +3,11 @@ package dht
 import (
 	"bytes"
 	"dht/bencode"
+	"errors"
 	"fmt"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -28,3 +32,128 @@ func TestNode(t *testing.T) {
 		t.Fatal("output of node.String was not the same as input")
 	}
 }
+
+func TestNodesBencode(t *testing.T) {
+	input := []byte{70, 71, 72, 73, 74, 75, 76, 77, 78, 79, 70, 71, 72, 73, 74, 75, 76, 77, 78, 79, 90, 90, 90, 90, 65, 65}
+	input = append(input, input...)
+	input[BytesInID] = 91
+	v := struct {
+		Nodes Nodes `bencode:"nodes"`
+	}{}
+	if err := bencode.D(bencode.P(bencode.S("nodes"), bencode.String(input))).Unmarshal(reflect.ValueOf(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Nodes) != 2 {
+		t.Fatal("wrong number of nodes were parsed", len(v.Nodes))
+	}
+	if !v.Nodes[0].IP.Equal([]byte{91, 90, 90, 90}) || !v.Nodes[1].IP.Equal([]byte{90, 90, 90, 90}) {
+		t.Fatal("nodes have unexpected ip addresses")
+	}
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d5:nodes52:"+string(input)+"e" {
+		t.Fatal("nodes did not marshal back to their compact form")
+	}
+	n := Node{}
+	if err := bencode.Unmarshal([]byte("3:abc"), &n); err == nil {
+		t.Fatal("node should not unmarshal from short string")
+	}
+}
+
+func TestParseNodes(t *testing.T) {
+	id := []byte(strings.Repeat("a", BytesInID))
+	v4 := Node{id, net.IP{127, 0, 0, 1}, 6881}
+	v6 := Node{id, net.ParseIP("2001:db8::1"), 51413}
+	for _, c := range []struct {
+		parse func([]byte) ([]Node, error)
+		node  Node
+		size  int
+	}{
+		{ParseNodes, v4, compressedNodeSize},
+		{ParseNodes6, v6, compressedNode6Size},
+	} {
+		raw := c.node.String() + c.node.String()
+		if len(raw) != 2*c.size {
+			t.Fatal("compact node has the wrong size", len(raw))
+		}
+		nodes, err := c.parse([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 2 || !sameNode(nodes[1], c.node) || nodes[1].IPv6() != c.node.IPv6() {
+			t.Fatal("nodes were not parsed", nodes)
+		}
+		if _, err := c.parse([]byte(raw[1:])); err == nil {
+			t.Fatal("nodes of the wrong size should not parse")
+		}
+	}
+	// each format rejects the other unless the sizes happen to line up
+	if _, err := ParseNodes([]byte(v6.String())); err == nil {
+		t.Fatal("nodes6 should not parse as nodes")
+	}
+	if _, err := ParseNodes6([]byte(v4.String())); err == nil {
+		t.Fatal("nodes should not parse as nodes6")
+	}
+	if (Node{id, net.IPv6unspecified, 6881}).Valid(nil) {
+		t.Fatal("node with an unspecified ip should not be valid")
+	}
+}
+
+func TestMessageHandlerLimits(t *testing.T) {
+	mh, handled := New(), 0
+	if err := mh.RegisterHandler(QueryType, func(Requester, bencode.Dict) error {
+		handled++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	req := UDPRequester{&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}}
+	if err := mh.HandleBytes(req, []byte("d1:q4:ping1:t2:aa1:y1:qe")); err != nil || handled != 1 {
+		t.Fatal("valid message was not handled", err)
+	}
+	deep := "d1:a" + strings.Repeat("l", MessageLimits.MaxDepth) + strings.Repeat("e", MessageLimits.MaxDepth) + "1:y1:qe"
+	if err := mh.Handle(req, strings.NewReader(deep)); !errors.Is(err, bencode.ErrMaxDepth) {
+		t.Fatal("expected depth limit error but got", err)
+	}
+	if err := mh.HandleBytes(req, []byte("d1:a999999:x1:y1:qe")); !errors.Is(err, bencode.ErrMaxStringLen) {
+		t.Fatal("expected string length limit error but got", err)
+	}
+	if handled != 1 {
+		t.Fatal("messages over the limits were handled")
+	}
+	if err := mh.HandleBytes(req, []byte("d1:y0:e")); err == nil {
+		t.Fatal("message with an empty type should not be handled")
+	}
+}
+
+func BenchmarkKRPCEncode(b *testing.B) {
+	msg := bencode.D(
+		bencode.P(bencode.S("a"), bencode.D(
+			bencode.P(bencode.S("id"), bencode.S(strings.Repeat("a", BytesInID))),
+			bencode.P(bencode.S("target"), bencode.S(strings.Repeat("b", BytesInID))),
+		)),
+		bencode.P(bencode.S("q"), bencode.S("find_node")),
+		bencode.P(bencode.S("t"), bencode.S("aa")),
+		bencode.P(bencode.S("y"), bencode.S("q")),
+	)
+	b.ReportAllocs()
+	b.Run("Bytes", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if len(msg.Bytes()) == 0 {
+				b.Fatal("empty message")
+			}
+		}
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			buf := bencode.AcquireBuffer()
+			*buf = msg.AppendBencode(*buf)
+			if len(*buf) == 0 {
+				b.Fatal("empty message")
+			}
+			bencode.ReleaseBuffer(buf)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	b "dht/bencode"
+	"errors"
+	"fmt"
+)
+
+// KRPCError is an error sent in, or received from, a KRPC error message.
+type KRPCError struct {
+	Code    int64
+	Message string
+}
+
+// Standard KRPC error codes.
+const (
+	ErrorGeneric       int64 = 201
+	ErrorServer        int64 = 202
+	ErrorProtocol      int64 = 203
+	ErrorMethodUnknown int64 = 204
+	// Errors for put queries, see BEP 44.
+	ErrorMessageTooBig    int64 = 205
+	ErrorInvalidSignature int64 = 206
+	ErrorSaltTooBig       int64 = 207
+	ErrorCASMismatch      int64 = 301
+	ErrorSeqTooLow        int64 = 302
+)
+
+var errorNames = map[int64]string{
+	ErrorGeneric:          "Generic Error",
+	ErrorServer:           "Server Error",
+	ErrorProtocol:         "Protocol Error",
+	ErrorMethodUnknown:    "Method Unknown",
+	ErrorMessageTooBig:    "Message Too Big",
+	ErrorInvalidSignature: "Invalid Signature",
+	ErrorSaltTooBig:       "Salt Too Big",
+	ErrorCASMismatch:      "CAS Mismatch",
+	ErrorSeqTooLow:        "Sequence Number Too Low",
+}
+
+func NewKRPCError(code int64, msg string) *KRPCError { return &KRPCError{code, msg} }
+
+func (e *KRPCError) Error() string {
+	if name, ok := errorNames[e.Code]; ok {
+		return fmt.Sprintf("krpc error %d (%s): %s", e.Code, name, e.Message)
+	}
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// SendError replies to the query with transaction id t that caused err. A
+// KRPCError is sent as is, any other error is sent as a server error without
+// its message since it is not meant for other nodes.
+func SendError(s Sender, req Requester, t b.String, err error) {
+	var ke *KRPCError
+	if !errors.As(err, &ke) {
+		ke = NewKRPCError(ErrorServer, errorNames[ErrorServer])
+	}
+	s.Send(Message{
+		Data:      ErrorResponse{t.Clone(), *ke}.Encode(),
+		Requester: req,
+	})
+}
+
+// ReceiveError is a Handler for error messages that returns the KRPCError
+// sent by the remote node.
+func ReceiveError(_ Requester, d b.Dict) error {
+	m := ErrorResponse{}
+	if err := m.Decode(d); err != nil {
+		return err
+	}
+	return &m.KRPCError
+}
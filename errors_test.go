@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"dht/bencode"
+	"errors"
+	"net"
+	"testing"
+)
+
+type sendRecorder struct {
+	sent []Message
+}
+
+func (s *sendRecorder) Send(m Message) { s.sent = append(s.sent, m) }
+
+func TestSendError(t *testing.T) {
+	s, req := &sendRecorder{}, UDPRequester{&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}}
+	SendError(s, req, bencode.S("aa"), NewKRPCError(ErrorMethodUnknown, "no such query"))
+	SendError(s, req, bencode.S("bb"), errors.New("secret internal failure"))
+	expected := []string{
+		"d1:eli204e13:no such querye1:t2:aa1:y1:ee",
+		"d1:eli202e12:Server Errore1:t2:bb1:y1:ee",
+	}
+	if len(s.sent) != len(expected) {
+		t.Fatal("wrong number of errors sent", len(s.sent))
+	}
+	for i, m := range s.sent {
+		if m.Data.String() != expected[i] || m.Requester != req {
+			t.Fatal("wrong error sent", m.Data.String())
+		}
+	}
+}
+
+func TestReceiveError(t *testing.T) {
+	d, err := bencode.DecodeFromString("d1:eli203e9:bad tokene1:t2:aa1:y1:ee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReceiveError(nil, d.(bencode.Dict))
+	var ke *KRPCError
+	if !errors.As(err, &ke) || ke.Code != ErrorProtocol || ke.Message != "bad token" {
+		t.Fatal("error was not parsed", err)
+	}
+	if err.Error() != "krpc error 203 (Protocol Error): bad token" {
+		t.Fatal("unexpected error message", err)
+	}
+}
@@ -0,0 +1,193 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	b "dht/bencode"
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// Item is a value stored in the DHT, as described in BEP 44. An
+	// immutable item is found under the SHA-1 of its value while a mutable
+	// item is found under the SHA-1 of the public key K and Salt, and can be
+	// changed by whoever holds the matching private key by signing a value
+	// with a higher Seq.
+	Item struct {
+		V         b.Bencoder
+		K, Salt   b.String
+		Seq       int64
+		Signature b.String
+	}
+	// ItemStore keeps the items put to a Server until they expire.
+	ItemStore struct {
+		now   func() time.Time
+		mu    sync.Mutex
+		items map[string]storedItem
+	}
+	storedItem struct {
+		Item
+		stored time.Time
+	}
+)
+
+const (
+	// ItemTimeout is how long an item is kept after it was last put.
+	ItemTimeout = 2 * time.Hour
+	// MaxItemSize is the largest bencoded value an item can hold.
+	MaxItemSize = 1000
+	// MaxSaltSize is the largest salt a mutable item can have.
+	MaxSaltSize = 64
+	maxItems    = 1 << 14
+)
+
+var ErrItemNotFound = errors.New("dht: no node returned a valid item")
+
+// NewImmutableItem returns the immutable item holding v.
+func NewImmutableItem(v b.Bencoder) Item { return Item{V: v} }
+
+// NewMutableItem returns the mutable item holding v at seq under the public
+// key of priv and salt, signed with priv.
+func NewMutableItem(priv ed25519.PrivateKey, salt b.String, seq int64, v b.Bencoder) Item {
+	ret := Item{
+		V:    v,
+		K:    b.String(priv.Public().(ed25519.PublicKey)),
+		Salt: salt,
+		Seq:  seq,
+	}
+	ret.Signature = ed25519.Sign(priv, ret.signed())
+	return ret
+}
+
+// MutableTarget returns the target a mutable item with the public key k and
+// salt is stored under.
+func MutableTarget(k, salt b.String) b.String {
+	h := sha1.New()
+	h.Write(k)
+	h.Write(salt)
+	return h.Sum(nil)
+}
+
+func (i Item) Mutable() bool { return len(i.K) > 0 }
+
+// Target returns the key i is stored under.
+func (i Item) Target() b.String {
+	if i.Mutable() {
+		return MutableTarget(i.K, i.Salt)
+	}
+	h := sha1.Sum(i.V.Bytes())
+	return h[:]
+}
+
+// signed returns the bytes covered by the signature of a mutable item.
+func (i Item) signed() []byte {
+	ret := make([]byte, 0, MaxItemSize)
+	if len(i.Salt) > 0 {
+		ret = append(ret, "4:salt"...)
+		ret = i.Salt.AppendBencode(ret)
+	}
+	ret = append(ret, "3:seq"...)
+	ret = b.I(i.Seq).AppendBencode(ret)
+	ret = append(ret, "1:v"...)
+	return i.V.AppendBencode(ret)
+}
+
+// Verify checks that i can be stored, returning a KRPCError with the code a
+// put of i should be rejected with when it cannot.
+func (i Item) Verify() error {
+	if i.V == nil {
+		return NewKRPCError(ErrorProtocol, "item has no value")
+	}
+	if len(i.V.Bytes()) > MaxItemSize {
+		return NewKRPCError(ErrorMessageTooBig, "item value is too big")
+	}
+	if !i.Mutable() {
+		return nil
+	}
+	if len(i.Salt) > MaxSaltSize {
+		return NewKRPCError(ErrorSaltTooBig, "item salt is too big")
+	}
+	if len(i.K) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(i.K), i.signed(), i.Signature) {
+		return NewKRPCError(ErrorInvalidSignature, "item signature is invalid")
+	}
+	return nil
+}
+
+// clone returns a copy of i that does not alias the message it was decoded
+// from.
+func (i Item) clone() Item {
+	return Item{b.Clone(i.V), i.K.Clone(), i.Salt.Clone(), i.Seq, i.Signature.Clone()}
+}
+
+// NewItemStore returns an empty store that reads the time from now, which
+// defaults to time.Now when nil.
+func NewItemStore(now func() time.Time) *ItemStore {
+	if now == nil {
+		now = time.Now
+	}
+	return &ItemStore{now: now, items: make(map[string]storedItem)}
+}
+
+// Put verifies and stores item. A mutable item only replaces a stored one with
+// a higher sequence number, or the same one to refresh it, and when cas is set
+// the stored item must have that sequence number.
+func (st *ItemStore) Put(item Item, cas *int64) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	target := item.Target().Raw()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := st.now()
+	old, ok := st.items[target]
+	if ok && now.Sub(old.stored) >= ItemTimeout {
+		delete(st.items, target)
+		ok = false
+	}
+	if ok && item.Mutable() {
+		switch {
+		case cas != nil && *cas != old.Seq:
+			return NewKRPCError(ErrorCASMismatch, "stored item has a different sequence number")
+		case item.Seq < old.Seq:
+			return NewKRPCError(ErrorSeqTooLow, "stored item has a higher sequence number")
+		case item.Seq == old.Seq && !bytes.Equal(item.V.Bytes(), old.V.Bytes()):
+			return NewKRPCError(ErrorSeqTooLow, "stored item has the same sequence number")
+		}
+	}
+	if !ok && len(st.items) >= maxItems {
+		st.expire(now)
+		if len(st.items) >= maxItems {
+			return NewKRPCError(ErrorServer, "item store is full")
+		}
+	}
+	st.items[target] = storedItem{item.clone(), now}
+	return nil
+}
+
+// Get returns the item stored under target, if it has not expired.
+func (st *ItemStore) Get(target b.String) (Item, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	item, ok := st.items[target.Raw()]
+	if !ok || st.now().Sub(item.stored) >= ItemTimeout {
+		return Item{}, false
+	}
+	return item.Item, true
+}
+
+func (st *ItemStore) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.items)
+}
+
+func (st *ItemStore) expire(now time.Time) {
+	for target, item := range st.items {
+		if now.Sub(item.stored) >= ItemTimeout {
+			delete(st.items, target)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"dht/bencode"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustHex(t *testing.T, s string) bencode.String {
+	ret, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// TestItemVectors checks items against the test vectors of BEP 44.
+func TestItemVectors(t *testing.T) {
+	v := bencode.S("Hello World!")
+	if target := NewImmutableItem(v).Target(); !target.Equal(mustHex(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb")) {
+		t.Fatal("wrong target for immutable item", hex.EncodeToString(target))
+	}
+	k := mustHex(t, "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	for salt, expected := range map[string][2]string{
+		"": {
+			"305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+			"4a533d47ec9c7d95b1ad75f576cffc641853b750",
+		},
+		"foobar": {
+			"6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+			"411eba73b6f087ca51a3795d9c8c938d365e32c1",
+		},
+	} {
+		item := Item{V: v, K: k, Salt: bencode.S(salt), Seq: 1, Signature: mustHex(t, expected[0])}
+		if err := item.Verify(); err != nil {
+			t.Fatal("signature of test vector was not valid", salt, err)
+		}
+		if target := item.Target(); !target.Equal(mustHex(t, expected[1])) {
+			t.Fatal("wrong target for mutable item", salt, hex.EncodeToString(target))
+		}
+		item.Seq = 2
+		if item.Verify() == nil {
+			t.Fatal("signature should not be valid for another sequence number")
+		}
+	}
+}
+
+func TestItemVerify(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for item, code := range map[*Item]int64{
+		{}: ErrorProtocol,
+		{V: bencode.S(strings.Repeat("a", MaxItemSize))}:                                                                ErrorMessageTooBig,
+		{V: bencode.S("a"), K: bencode.S("short")}:                                                                      ErrorInvalidSignature,
+		{V: bencode.S("a"), K: bencode.S(strings.Repeat("k", 32)), Salt: bencode.S(strings.Repeat("s", MaxSaltSize+1))}: ErrorSaltTooBig,
+	} {
+		var ke *KRPCError
+		if err := item.Verify(); !errors.As(err, &ke) || ke.Code != code {
+			t.Fatal("wrong error for invalid item", item, err)
+		}
+	}
+	item := NewMutableItem(priv, bencode.S("salt"), 3, bencode.L(bencode.I(1), bencode.S("two")))
+	if err := item.Verify(); err != nil {
+		t.Fatal("signed item was not valid", err)
+	}
+	item.V = bencode.I(2)
+	if item.Verify() == nil {
+		t.Fatal("changed item should not be valid")
+	}
+}
+
+func TestItemStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	st := NewItemStore(func() time.Time { return now })
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	immutable := NewImmutableItem(bencode.S("hello"))
+	if err := st.Put(immutable, nil); err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := st.Get(immutable.Target()); !ok || item.V.String() != immutable.V.String() {
+		t.Fatal("immutable item was not stored")
+	}
+	put := func(seq int64, v string, cas *int64) error {
+		return st.Put(NewMutableItem(priv, nil, seq, bencode.S(v)), cas)
+	}
+	code := func(err error) int64 {
+		var ke *KRPCError
+		if errors.As(err, &ke) {
+			return ke.Code
+		}
+		return 0
+	}
+	one, two := int64(1), int64(2)
+	if err := put(1, "one", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(1, "one", nil); err != nil {
+		t.Fatal("putting the same item again should refresh it", err)
+	}
+	if code(put(1, "uno", nil)) != ErrorSeqTooLow || code(put(0, "zero", nil)) != ErrorSeqTooLow {
+		t.Fatal("item with a lower or equal sequence number should be rejected")
+	}
+	if code(put(2, "two", &two)) != ErrorCASMismatch {
+		t.Fatal("item with the wrong cas should be rejected")
+	}
+	if err := put(2, "two", &one); err != nil {
+		t.Fatal(err)
+	}
+	target := MutableTarget(bencode.String(priv.Public().(ed25519.PublicKey)), nil)
+	if item, ok := st.Get(target); !ok || item.Seq != 2 || item.V.String() != "3:two" {
+		t.Fatal("mutable item was not replaced", item)
+	}
+	now = now.Add(ItemTimeout)
+	if _, ok := st.Get(target); ok {
+		t.Fatal("item should have expired")
+	}
+	if err := put(1, "one", nil); err != nil {
+		t.Fatal("expired item should not block a lower sequence number", err)
+	}
+}
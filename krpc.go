@@ -12,9 +12,11 @@ type (
 	MessageHandler interface {
 		RegisterHandler(messageType b.String, f Handler) error
 		Handle(Requester, io.Reader) error
+		HandleBytes(Requester, []byte) error
 	}
 	messageHandler struct {
 		handlers map[byte]Handler
+		opts     b.DecoderOptions
 	}
 )
 
@@ -36,9 +38,15 @@ var (
 	QueryFind     = b.S("find_node")
 	QueryGet      = b.S("get_peers")
 	QueryAnnounce = b.S("announce_peer")
+	// Queries for storing items, see BEP 44
+	QueryGetItem = b.S("get")
+	QueryPutItem = b.S("put")
 	// Response specific keys
-	ResponseKey   = ResponseType
-	ResponseNodes = b.S("nodes")
+	ResponseKey    = ResponseType
+	ResponseNodes  = b.S("nodes")
+	ResponseValues = b.S("values")
+	// ResponseNodes6 holds IPv6 nodes, see BEP 32
+	ResponseNodes6 = b.S("nodes6")
 	// Error specific keys
 	ErrorKey = ErrorType
 	// Other common keys
@@ -46,23 +54,52 @@ var (
 	HashKey   = b.S("info_hash")
 	TokenKey  = b.S("token")
 	TargetKey = b.S("target")
+	PortKey   = b.S("port")
+	// ImpliedPortKey asks for the source port of the packet to be used
+	// instead of the value of PortKey.
+	ImpliedPortKey = b.S("implied_port")
+	// WantKey lists the address families of the nodes a query asks for.
+	WantKey  = b.S("want")
+	WantIPv4 = b.S("n4")
+	WantIPv6 = b.S("n6")
+	// Item keys, see BEP 44
+	ValueKey = b.S("v")
+	KeyKey   = b.S("k")
+	SaltKey  = b.S("salt")
+	SeqKey   = b.S("seq")
+	SigKey   = b.S("sig")
+	CASKey   = b.S("cas")
 	// Other common values
 	Empty = b.S("")
+	// MessageLimits bound the decoding of every incoming message, a message
+	// can never be larger than a UDP packet.
+	MessageLimits = b.DecoderOptions{
+		MaxDepth:      16,
+		MaxStringLen:  1 << 16,
+		MaxTotalBytes: 1 << 16,
+		MaxElements:   1 << 12,
+	}
 )
 
 func Noop(b.Dict) error { return nil }
-func LogOp(b b.Dict) error {
-	log.Println("Pretty Message:\n", b.Pretty("", "    "))
+func LogOp(d b.Dict) error {
+	data, err := b.ToJSON(d, b.JSONOptions{Indent: "    "})
+	if err != nil {
+		return err
+	}
+	log.Println("Message:\n", string(data))
 	return nil
 }
 
-func New() MessageHandler {
-	return &messageHandler{make(map[byte]Handler)}
+func New() MessageHandler { return NewWithOptions(MessageLimits) }
+
+func NewWithOptions(opts b.DecoderOptions) MessageHandler {
+	return &messageHandler{make(map[byte]Handler), opts}
 }
 
 func (mh *messageHandler) RegisterHandler(messageType b.String, f Handler) error {
-	if messageType.Len() > 1 {
-		return errors.New("MessageType field of message had more than one byte")
+	if messageType.Len() != 1 {
+		return errors.New("MessageType field of message did not have exactly one byte")
 	} else {
 		mh.handlers[messageType[0]] = f
 	}
@@ -70,7 +107,18 @@ func (mh *messageHandler) RegisterHandler(messageType b.String, f Handler) error
 }
 
 func (mh *messageHandler) Handle(req Requester, r io.Reader) error {
-	msg, err := b.Decode(r)
+	return mh.decode(req, b.NewDecoder(r))
+}
+
+// HandleBytes handles the message in data without copying it. Handlers must
+// Clone anything they keep after returning since data may be reused.
+func (mh *messageHandler) HandleBytes(req Requester, data []byte) error {
+	return mh.decode(req, b.NewBytesDecoder(data))
+}
+
+func (mh *messageHandler) decode(req Requester, dec *b.Decoder) error {
+	dec.SetOptions(mh.opts)
+	msg, err := dec.Value()
 	if err != nil {
 		return err
 	}
@@ -83,8 +131,8 @@ func (mh *messageHandler) Handle(req Requester, r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	if mt.Len() > 1 {
-		return errors.New("MessageType field of message had more than one byte")
+	if mt.Len() != 1 {
+		return errors.New("MessageType field of message did not have exactly one byte")
 	}
 	if handler := mh.handlers[mt[0]]; handler != nil {
 		return handler(req, d)
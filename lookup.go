@@ -0,0 +1,271 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	b "dht/bencode"
+	"errors"
+	"sort"
+	"sync"
+)
+
+type (
+	// Lookup is an iterative Kademlia search for the nodes closest to a
+	// target. It keeps a shortlist of nodes ordered by their distance from
+	// the target, queries up to Alpha of them at a time and stops once the K
+	// closest nodes it knows of have all responded. A get_peers lookup also
+	// collects the peers and tokens sent back along the way, and a get lookup
+	// the tokens and the newest valid item.
+	Lookup struct {
+		server   *Server
+		target   b.String
+		kind     lookupKind
+		alpha, k int
+		// salt is the salt of the mutable item a get lookup is for
+		salt b.String
+	}
+	lookupKind int
+	// LookupNode is a node that responded to a lookup along with the token
+	// it sent, which is only set for get_peers and get lookups.
+	LookupNode struct {
+		Node
+		Token b.String
+	}
+	LookupResult struct {
+		// Closest are the nodes closest to the target that responded,
+		// closest first.
+		Closest []LookupNode
+		Peers   Peers
+		// Item is the item with the highest sequence number found by a get
+		// lookup.
+		Item *Item
+	}
+	candidate struct {
+		node  Node
+		token b.String
+		state candidateState
+	}
+	candidateState int
+	lookupReply    struct {
+		c     *candidate
+		id    b.String
+		token b.String
+		nodes Nodes
+		peers Peers
+		item  *Item
+		err   error
+	}
+)
+
+const (
+	lookupNodes lookupKind = iota
+	lookupPeers
+	lookupItem
+)
+
+const (
+	candidateNew candidateState = iota
+	candidateWaiting
+	candidateResponded
+	candidateFailed
+)
+
+const (
+	// Alpha is the number of queries a Lookup has in flight at once.
+	Alpha = 3
+)
+
+var ErrNoNodes = errors.New("dht: lookup has no nodes to start from")
+
+// NewLookup returns a lookup for target that sends its queries through s. It
+// sends get_peers queries when getPeers is set and find_node queries
+// otherwise.
+func NewLookup(s *Server, target b.String, getPeers bool) *Lookup {
+	kind := lookupNodes
+	if getPeers {
+		kind = lookupPeers
+	}
+	return &Lookup{server: s, target: target, kind: kind, alpha: Alpha, k: K}
+}
+
+// NewItemLookup returns a lookup that sends get queries for the item stored
+// under target, salt must be the salt of the item when it is mutable.
+func NewItemLookup(s *Server, target, salt b.String) *Lookup {
+	return &Lookup{server: s, target: target, kind: lookupItem, alpha: Alpha, k: K, salt: salt}
+}
+
+// query sends the query of the lookup to c and passes the reply to replies.
+func (l *Lookup) query(ctx context.Context, c *candidate, replies chan<- lookupReply) {
+	reply := lookupReply{c: c}
+	switch l.kind {
+	case lookupPeers:
+		var r GetPeersResponse
+		if r, reply.err = l.server.GetPeers(ctx, c.node, l.target); reply.err == nil {
+			reply.id, reply.token, reply.nodes, reply.peers = r.ID, r.Token, r.Nodes, r.Values
+		}
+	case lookupItem:
+		var r GetItemResponse
+		if r, reply.err = l.server.GetItem(ctx, c.node, l.target, nil); reply.err == nil {
+			reply.id, reply.token, reply.nodes, reply.item = r.ID, r.Token, r.Nodes, l.valid(r.Item)
+		}
+	default:
+		var d b.Dict
+		if d, reply.err = l.server.Query(ctx, c.node, &FindNodeQuery{ID: l.server.id, Target: l.target}); reply.err == nil {
+			r := FindNodeResponse{}
+			if reply.err = r.Decode(d); reply.err == nil {
+				reply.id, reply.nodes = r.ID, r.Nodes
+			}
+		}
+	}
+	replies <- reply
+}
+
+// Run performs the lookup starting from start, or from the closest nodes in
+// the routing table of the server when start is empty. When ctx is done the
+// result found so far is returned along with the error of ctx.
+func (l *Lookup) Run(ctx context.Context, start Nodes) (LookupResult, error) {
+	if len(start) == 0 {
+		s := l.server
+		start = s.closest(l.target, true, s.ipv6)
+	}
+	if len(start) == 0 {
+		return LookupResult{}, ErrNoNodes
+	}
+	var (
+		shortlist = make([]*candidate, 0, len(start))
+		seen      = make(map[string]*candidate)
+		seenPeers = make(map[string]bool)
+		peers     = Peers{}
+		item      *Item
+		// at most alpha queries are in flight so replies never blocks
+		replies  = make(chan lookupReply, l.alpha)
+		inFlight = 0
+	)
+	add := func(nodes Nodes) {
+		for _, n := range nodes {
+			if !n.Valid(l.server.id) || !l.server.reachable(n) || seen[string(n.ID)] != nil {
+				continue
+			}
+			c := &candidate{node: n}
+			seen[string(n.ID)] = c
+			shortlist = append(shortlist, c)
+		}
+	}
+	add(start)
+	for {
+		l.sort(shortlist)
+		closest, done := 0, true
+		for _, c := range shortlist {
+			if closest == l.k {
+				break
+			}
+			switch c.state {
+			case candidateFailed:
+				continue
+			case candidateNew:
+				if inFlight < l.alpha {
+					c.state = candidateWaiting
+					inFlight++
+					go l.query(ctx, c, replies)
+				}
+				done = false
+			case candidateWaiting:
+				done = false
+			}
+			closest++
+		}
+		if done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return l.result(shortlist, peers, item), ctx.Err()
+		case reply := <-replies:
+			inFlight--
+			c := reply.c
+			if reply.err != nil {
+				c.state = candidateFailed
+				continue
+			}
+			c.state, c.token = candidateResponded, reply.token
+			// the id of a bootstrap node is only known once it responds
+			if !bytes.Equal(c.node.ID, reply.id) {
+				if seen[string(reply.id)] != nil {
+					c.state = candidateFailed
+				} else {
+					delete(seen, string(c.node.ID))
+					c.node.ID = reply.id
+					seen[string(reply.id)] = c
+				}
+			}
+			add(reply.nodes)
+			for _, p := range reply.peers {
+				if raw := p.String(); !seenPeers[raw] {
+					seenPeers[raw] = true
+					peers = append(peers, p)
+				}
+			}
+			if reply.item != nil && (item == nil || reply.item.Seq > item.Seq) {
+				item = reply.item
+			}
+		}
+	}
+	return l.result(shortlist, peers, item), nil
+}
+
+func (l *Lookup) sort(shortlist []*candidate) {
+	sort.SliceStable(shortlist, func(i, j int) bool {
+		return closer(l.target, shortlist[i].node.ID, shortlist[j].node.ID)
+	})
+}
+
+// valid returns item when it is stored under the target of the lookup and
+// nil otherwise.
+func (l *Lookup) valid(item *Item) *Item {
+	if item == nil {
+		return nil
+	}
+	item.Salt = l.salt
+	if !item.Target().Equal(l.target) || item.Verify() != nil {
+		return nil
+	}
+	return item
+}
+
+// result returns the k closest candidates in shortlist that responded.
+func (l *Lookup) result(shortlist []*candidate, peers Peers, item *Item) LookupResult {
+	l.sort(shortlist)
+	ret := LookupResult{Peers: peers, Item: item}
+	for _, c := range shortlist {
+		if len(ret.Closest) == l.k {
+			break
+		}
+		if c.state == candidateResponded {
+			ret.Closest = append(ret.Closest, LookupNode{c.node, c.token})
+		}
+	}
+	return ret
+}
+
+// queryAll sends the query made by msg to each of nodes at once and returns
+// the number of them that responded without an error.
+func (s *Server) queryAll(ctx context.Context, nodes []LookupNode, msg func(LookupNode) KRPCMessage) int {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted = 0
+	)
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n LookupNode) {
+			defer wg.Done()
+			if _, err := s.Query(ctx, n.Node, msg(n)); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	return accepted
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// testNetwork returns servers that each know the next few servers after them.
+func testNetwork(t *testing.T, n int) ([]*Server, Nodes) {
+	servers, nodes := testServers(t, n)
+	for i, s := range servers {
+		for j := 1; j <= 3; j++ {
+			if err := s.Ping(context.Background(), nodes[(i+j)%n]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return servers, nodes
+}
+
+func TestLookupFindNode(t *testing.T) {
+	servers, nodes := testNetwork(t, 30)
+	target := nodes[20].ID
+	r, err := NewLookup(servers[0], target, false).Run(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Closest) != K {
+		t.Fatal("lookup should find k nodes", len(r.Closest))
+	}
+	for i, n := range r.Closest {
+		if i > 0 && closer(target, n.ID, r.Closest[i-1].ID) {
+			t.Fatal("closest nodes were not sorted")
+		}
+	}
+	if !sameNode(r.Closest[0].Node, nodes[20]) {
+		t.Fatal("target node was not found", r.Closest[0])
+	}
+	if _, err := NewLookup(servers[0], target, false).Run(context.Background(), Nodes{}); err != nil {
+		t.Fatal("lookup should start from the routing table", err)
+	}
+	empty, _ := testServers(t, 1)
+	if _, err := NewLookup(empty[0], target, false).Run(context.Background(), nil); err != ErrNoNodes {
+		t.Fatal("lookup without nodes should fail", err)
+	}
+}
+
+func TestLookupGetPeers(t *testing.T) {
+	servers, nodes := testNetwork(t, 30)
+	infohash := testID(nodes[10].ID[0], 0xff)
+	peer := NewPeer(net.IP{10, 0, 0, 1}, 6881)
+	servers[10].AddPeer(infohash, peer)
+	servers[11].AddPeer(infohash, peer)
+	// a bootstrap node has a random id until it responds
+	bootstrap := Node{testID(0xff, 0xff), nodes[25].IP, nodes[25].port}
+	r, err := NewLookup(servers[0], infohash, true).Run(context.Background(), Nodes{bootstrap})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Peers) != 1 || r.Peers[0].String() != peer.String() {
+		t.Fatal("wrong peers found", r.Peers)
+	}
+	for _, n := range r.Closest {
+		if n.Token.Len() != tokenSize {
+			t.Fatal("node did not send a token", n)
+		}
+		if n.ID[0] == 0xff && n.ID[BytesInID-1] == 0xff {
+			t.Fatal("bootstrap node kept its random id")
+		}
+	}
+}
+
+func TestLookupCancel(t *testing.T) {
+	// nothing answers queries sent by this server
+	s, err := NewServer(testID(0x10, 0), &sendRecorder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewLookup(s, testID(0x20, 0), false).Run(ctx, Nodes{testNode(testID(0x30, 0), 1)}); err != context.DeadlineExceeded {
+		t.Fatal("lookup should stop when cancelled", err)
+	}
+}
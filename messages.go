@@ -0,0 +1,638 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	b "dht/bencode"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+type (
+	// KRPCMessage is a typed KRPC query, response or error. Decode ignores any
+	// keys it does not know about and the Strings of a decoded message may
+	// alias the Dict it was decoded from.
+	KRPCMessage interface {
+		Encode() b.Dict
+		Decode(b.Dict) error
+	}
+	// Peer is the address of a peer downloading a torrent, as found in the
+	// values of a get_peers response.
+	Peer struct {
+		net.IP
+		port uint16
+	}
+	Peers     []Peer
+	PingQuery struct {
+		TransactionID, ID b.String
+	}
+	// FindNodeQuery asks for nodes of the address families in Want, which
+	// are WantIPv4 and WantIPv6, or of the family of the sender when it is
+	// empty.
+	FindNodeQuery struct {
+		TransactionID, ID, Target b.String
+		Want                      []b.String
+	}
+	GetPeersQuery struct {
+		TransactionID, ID, InfoHash b.String
+		Want                        []b.String
+	}
+	AnnouncePeerQuery struct {
+		TransactionID, ID, InfoHash, Token b.String
+		Port                               uint16
+		ImpliedPort                        bool
+	}
+	PingResponse struct {
+		TransactionID, ID b.String
+	}
+	// GetItemQuery asks for the item stored under Target, only if its
+	// sequence number is higher than Seq when that is set.
+	GetItemQuery struct {
+		TransactionID, ID, Target b.String
+		Seq                       *int64
+	}
+	// PutItemQuery stores Item, only if the stored item has the sequence
+	// number CAS when that is set.
+	PutItemQuery struct {
+		TransactionID, ID, Token b.String
+		Item                     Item
+		CAS                      *int64
+	}
+	// AnnouncePeerResponse holds the same values as a PingResponse.
+	AnnouncePeerResponse = PingResponse
+	// PutItemResponse holds the same values as a PingResponse.
+	PutItemResponse  = PingResponse
+	FindNodeResponse struct {
+		TransactionID, ID b.String
+		Nodes             Nodes
+	}
+	GetPeersResponse struct {
+		TransactionID, ID, Token b.String
+		Nodes                    Nodes
+		Values                   Peers
+	}
+	// GetItemResponse holds the item that was asked for, if the node has it,
+	// along with the nodes closest to its target.
+	GetItemResponse struct {
+		TransactionID, ID, Token b.String
+		Nodes                    Nodes
+		Item                     *Item
+	}
+	ErrorResponse struct {
+		TransactionID b.String
+		KRPCError
+	}
+)
+
+const (
+	compactPeerSize  = net.IPv4len + portSize
+	compactPeer6Size = net.IPv6len + portSize
+)
+
+func NewPeer(ip net.IP, port uint16) Peer { return Peer{ip, port} }
+
+// ParsePeer parses a compact IPv4 or IPv6 peer.
+func ParsePeer(data []byte) (Peer, error) {
+	if len(data) != compactPeerSize && len(data) != compactPeer6Size {
+		return Peer{}, errors.New("compact peer was invalid, wrong size")
+	}
+	ipEnd := len(data) - portSize
+	return Peer{net.IP(data[:ipEnd]), binary.BigEndian.Uint16(data[ipEnd:])}, nil
+}
+
+func (p Peer) String() string {
+	ip := compactIP(p.IP)
+	ret := make([]byte, len(ip)+portSize)
+	copy(ret, ip)
+	binary.BigEndian.PutUint16(ret[len(ip):], p.port)
+	return string(ret)
+}
+
+// IPv6 reports whether p is an IPv6 peer.
+func (p Peer) IPv6() bool { return isIPv6(p.IP) }
+
+func (p Peer) Port() int      { return int(p.port) }
+func (p Peer) Addr() net.Addr { return &net.UDPAddr{IP: p.IP, Port: int(p.port), Zone: ""} }
+
+func (ps Peers) list() b.List {
+	ret := make(b.List, 0, len(ps))
+	for _, p := range ps {
+		ret = append(ret, b.S(p.String()))
+	}
+	return ret
+}
+
+// compact returns the compact form of either the IPv4 or the IPv6 nodes in ns.
+func (ns Nodes) compact(ipv6 bool) b.String {
+	ret := make(b.String, 0, len(ns)*compressedNodeSize)
+	for _, n := range ns {
+		if n.IPv6() == ipv6 {
+			ret = append(ret, n.String()...)
+		}
+	}
+	return ret
+}
+
+// setNodes adds the IPv4 nodes in ns to r under nodes and the IPv6 nodes under
+// nodes6, which is only added when there are any.
+func (ns Nodes) setNodes(r b.Dict) b.Dict {
+	r = r.Set(ResponseNodes, ns.compact(false))
+	if nodes6 := ns.compact(true); nodes6.Len() > 0 {
+		r = r.Set(ResponseNodes6, nodes6)
+	}
+	return r
+}
+
+func query(t, q b.String, args b.Dict) b.Dict {
+	return b.D(
+		b.P(QueryArgs, args),
+		b.P(QueryKey, q),
+		b.P(TransactionID, t),
+		b.P(MessageType, QueryType),
+	)
+}
+
+func response(t b.String, r b.Dict) b.Dict {
+	return b.D(
+		b.P(ResponseKey, r),
+		b.P(TransactionID, t),
+		b.P(MessageType, ResponseType),
+	)
+}
+
+// header checks that d has the message type typ and returns its transaction
+// id.
+func header(d b.Dict, typ b.String) (b.String, error) {
+	mt, err := d.GetString(MessageType)
+	if err != nil {
+		return nil, err
+	}
+	if !mt.Equal(typ) {
+		return nil, errors.New("message has the wrong type: " + mt.Raw())
+	}
+	return d.GetString(TransactionID)
+}
+
+// body returns the transaction id of d along with the dict found under key.
+func body(d b.Dict, typ, key b.String) (b.String, b.Dict, error) {
+	t, err := header(d, typ)
+	if err != nil {
+		return nil, nil, err
+	}
+	inner, err := d.GetDict(key)
+	return t, inner, err
+}
+
+func decodeQuery(d b.Dict, q b.String) (b.String, b.Dict, error) {
+	name, err := d.GetString(QueryKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !name.Equal(q) {
+		return nil, nil, errors.New("query has the wrong name: " + name.Raw())
+	}
+	return body(d, QueryType, QueryArgs)
+}
+
+func decodeResponse(d b.Dict) (b.String, b.Dict, error) {
+	return body(d, ResponseType, ResponseKey)
+}
+
+// getID returns the value of k in d, which must be a 20 byte id or infohash.
+func getID(d b.Dict, k b.String) (b.String, error) {
+	id, err := d.GetString(k)
+	if err != nil {
+		return nil, err
+	}
+	if id.Len() != BytesInID {
+		return nil, errors.New(k.Raw() + " has incorrect length")
+	}
+	return id, nil
+}
+
+// getNodes returns the nodes in both nodes and nodes6 of d, a response that
+// may not have any.
+func getNodes(d b.Dict) (Nodes, error) {
+	var ret Nodes
+	for _, k := range []b.String{ResponseNodes, ResponseNodes6} {
+		if d.Get(k) == nil {
+			continue
+		}
+		raw, err := d.GetString(k)
+		if err != nil {
+			return nil, err
+		}
+		parse := ParseNodes
+		if k.Equal(ResponseNodes6) {
+			parse = ParseNodes6
+		}
+		nodes, err := parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, nodes...)
+	}
+	return ret, nil
+}
+
+// getWant returns the address families asked for in the want list of a, a
+// query that may not have one.
+func getWant(a b.Dict) ([]b.String, error) {
+	if a.Get(WantKey) == nil {
+		return nil, nil
+	}
+	l, err := a.GetList(WantKey)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]b.String, 0, l.Len())
+	for _, v := range l {
+		w, ok := v.(b.String)
+		if !ok {
+			return nil, errors.New("want was not a list of Strings")
+		}
+		ret = append(ret, w)
+	}
+	return ret, nil
+}
+
+// setWant adds want to the arguments a of a query when it is not empty.
+func setWant(a b.Dict, want []b.String) b.Dict {
+	if len(want) == 0 {
+		return a
+	}
+	l := make(b.List, 0, len(want))
+	for _, w := range want {
+		l = append(l, w)
+	}
+	return a.Set(WantKey, l)
+}
+
+func (m PingQuery) Encode() b.Dict {
+	return query(m.TransactionID, QueryPing, b.D(b.P(IDKey, m.ID)))
+}
+
+func (m *PingQuery) Decode(d b.Dict) (err error) {
+	t, a, err := decodeQuery(d, QueryPing)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	m.ID, err = getID(a, IDKey)
+	return err
+}
+
+func (m FindNodeQuery) Encode() b.Dict {
+	return query(m.TransactionID, QueryFind, setWant(b.D(
+		b.P(IDKey, m.ID),
+		b.P(TargetKey, m.Target),
+	), m.Want))
+}
+
+func (m *FindNodeQuery) Decode(d b.Dict) (err error) {
+	t, a, err := decodeQuery(d, QueryFind)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(a, IDKey); err != nil {
+		return err
+	}
+	if m.Target, err = getID(a, TargetKey); err != nil {
+		return err
+	}
+	m.Want, err = getWant(a)
+	return err
+}
+
+func (m GetPeersQuery) Encode() b.Dict {
+	return query(m.TransactionID, QueryGet, setWant(b.D(
+		b.P(IDKey, m.ID),
+		b.P(HashKey, m.InfoHash),
+	), m.Want))
+}
+
+func (m *GetPeersQuery) Decode(d b.Dict) (err error) {
+	t, a, err := decodeQuery(d, QueryGet)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(a, IDKey); err != nil {
+		return err
+	}
+	if m.InfoHash, err = getID(a, HashKey); err != nil {
+		return err
+	}
+	m.Want, err = getWant(a)
+	return err
+}
+
+func (m AnnouncePeerQuery) Encode() b.Dict {
+	implied := b.I(0)
+	if m.ImpliedPort {
+		implied = b.I(1)
+	}
+	return query(m.TransactionID, QueryAnnounce, b.D(
+		b.P(IDKey, m.ID),
+		b.P(ImpliedPortKey, implied),
+		b.P(HashKey, m.InfoHash),
+		b.P(PortKey, b.I(int64(m.Port))),
+		b.P(TokenKey, m.Token),
+	))
+}
+
+func (m *AnnouncePeerQuery) Decode(d b.Dict) (err error) {
+	t, a, err := decodeQuery(d, QueryAnnounce)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(a, IDKey); err != nil {
+		return err
+	}
+	if m.InfoHash, err = getID(a, HashKey); err != nil {
+		return err
+	}
+	if m.Token, err = a.GetString(TokenKey); err != nil {
+		return err
+	}
+	if implied, err := a.GetInt(ImpliedPortKey); err == nil {
+		m.ImpliedPort = implied != 0
+	}
+	port, err := a.GetInt(PortKey)
+	if err != nil && !m.ImpliedPort {
+		return err
+	}
+	if port < 0 || port >= MaxPort {
+		return errors.New("port is invalid")
+	}
+	m.Port = uint16(port)
+	return nil
+}
+
+func (m PingResponse) Encode() b.Dict {
+	return response(m.TransactionID, b.D(b.P(IDKey, m.ID)))
+}
+
+func (m *PingResponse) Decode(d b.Dict) (err error) {
+	t, r, err := decodeResponse(d)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	m.ID, err = getID(r, IDKey)
+	return err
+}
+
+func (m FindNodeResponse) Encode() b.Dict {
+	return response(m.TransactionID, m.Nodes.setNodes(b.D(b.P(IDKey, m.ID))))
+}
+
+func (m *FindNodeResponse) Decode(d b.Dict) (err error) {
+	t, r, err := decodeResponse(d)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(r, IDKey); err != nil {
+		return err
+	}
+	m.Nodes, err = getNodes(r)
+	return err
+}
+
+// Encode writes the values of m when it has any and its nodes otherwise.
+func (m GetPeersResponse) Encode() b.Dict {
+	r := b.D(b.P(IDKey, m.ID), b.P(TokenKey, m.Token))
+	if len(m.Values) > 0 {
+		r = r.Set(ResponseValues, m.Values.list())
+	} else {
+		r = m.Nodes.setNodes(r)
+	}
+	return response(m.TransactionID, r)
+}
+
+func (m *GetPeersResponse) Decode(d b.Dict) (err error) {
+	t, r, err := decodeResponse(d)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(r, IDKey); err != nil {
+		return err
+	}
+	if m.Token, err = r.GetString(TokenKey); err != nil {
+		return err
+	}
+	if m.Nodes, err = getNodes(r); err != nil {
+		return err
+	}
+	m.Values = nil
+	if r.Get(ResponseValues) == nil {
+		return nil
+	}
+	values, err := r.GetList(ResponseValues)
+	if err != nil {
+		return err
+	}
+	m.Values = make(Peers, 0, values.Len())
+	for _, v := range values {
+		raw, ok := v.(b.String)
+		if !ok {
+			return errors.New("peer in values was not a String")
+		}
+		p, err := ParsePeer(raw)
+		if err != nil {
+			return err
+		}
+		m.Values = append(m.Values, p)
+	}
+	return nil
+}
+
+// getSeq returns the value of k in d, which must be a sequence number, or nil
+// when d does not have one.
+func getSeq(d b.Dict, k b.String) (*int64, error) {
+	if d.Get(k) == nil {
+		return nil, nil
+	}
+	seq, err := d.GetInt(k)
+	if err != nil {
+		return nil, err
+	}
+	ret := seq.Raw()
+	return &ret, nil
+}
+
+// getSized returns the value of k in d, which must have size bytes.
+func getSized(d b.Dict, k b.String, size int) (b.String, error) {
+	v, err := d.GetString(k)
+	if err != nil {
+		return nil, err
+	}
+	if v.Len() != size {
+		return nil, errors.New(k.Raw() + " has incorrect length")
+	}
+	return v, nil
+}
+
+// setItem adds the value of item to d along with its key, sequence number and
+// signature when it is mutable, and its salt when withSalt is set.
+func setItem(d b.Dict, item Item, withSalt bool) b.Dict {
+	d = d.Set(ValueKey, item.V)
+	if !item.Mutable() {
+		return d
+	}
+	d = d.Set(KeyKey, item.K).Set(SeqKey, b.I(item.Seq)).Set(SigKey, item.Signature)
+	if withSalt && item.Salt.Len() > 0 {
+		d = d.Set(SaltKey, item.Salt)
+	}
+	return d
+}
+
+// getItem returns the item in d, which is mutable when d has a key.
+func getItem(d b.Dict) (Item, error) {
+	ret := Item{V: d.Get(ValueKey)}
+	if ret.V == nil {
+		return ret, errors.New("item has no value")
+	}
+	if d.Get(KeyKey) == nil {
+		return ret, nil
+	}
+	var err error
+	if ret.K, err = getSized(d, KeyKey, ed25519.PublicKeySize); err != nil {
+		return ret, err
+	}
+	if ret.Signature, err = getSized(d, SigKey, ed25519.SignatureSize); err != nil {
+		return ret, err
+	}
+	seq, err := d.GetInt(SeqKey)
+	if err != nil {
+		return ret, err
+	}
+	ret.Seq = seq.Raw()
+	if d.Get(SaltKey) != nil {
+		ret.Salt, err = d.GetString(SaltKey)
+	}
+	return ret, err
+}
+
+func (m GetItemQuery) Encode() b.Dict {
+	a := b.D(b.P(IDKey, m.ID), b.P(TargetKey, m.Target))
+	if m.Seq != nil {
+		a = a.Set(SeqKey, b.I(*m.Seq))
+	}
+	return query(m.TransactionID, QueryGetItem, a)
+}
+
+func (m *GetItemQuery) Decode(d b.Dict) (err error) {
+	t, a, err := decodeQuery(d, QueryGetItem)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(a, IDKey); err != nil {
+		return err
+	}
+	if m.Target, err = getID(a, TargetKey); err != nil {
+		return err
+	}
+	m.Seq, err = getSeq(a, SeqKey)
+	return err
+}
+
+func (m PutItemQuery) Encode() b.Dict {
+	a := setItem(b.D(b.P(IDKey, m.ID), b.P(TokenKey, m.Token)), m.Item, true)
+	if m.CAS != nil {
+		a = a.Set(CASKey, b.I(*m.CAS))
+	}
+	return query(m.TransactionID, QueryPutItem, a)
+}
+
+func (m *PutItemQuery) Decode(d b.Dict) (err error) {
+	t, a, err := decodeQuery(d, QueryPutItem)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(a, IDKey); err != nil {
+		return err
+	}
+	if m.Token, err = a.GetString(TokenKey); err != nil {
+		return err
+	}
+	if m.Item, err = getItem(a); err != nil {
+		return err
+	}
+	m.CAS, err = getSeq(a, CASKey)
+	return err
+}
+
+// Encode writes the nodes of m along with its item when it has one, the salt
+// of the item is not sent back since the querying node already knows it.
+func (m GetItemResponse) Encode() b.Dict {
+	r := m.Nodes.setNodes(b.D(b.P(IDKey, m.ID), b.P(TokenKey, m.Token)))
+	if m.Item != nil {
+		r = setItem(r, *m.Item, false)
+	}
+	return response(m.TransactionID, r)
+}
+
+func (m *GetItemResponse) Decode(d b.Dict) (err error) {
+	t, r, err := decodeResponse(d)
+	if err != nil {
+		return err
+	}
+	m.TransactionID = t
+	if m.ID, err = getID(r, IDKey); err != nil {
+		return err
+	}
+	if m.Token, err = r.GetString(TokenKey); err != nil {
+		return err
+	}
+	if m.Nodes, err = getNodes(r); err != nil {
+		return err
+	}
+	m.Item = nil
+	if r.Get(ValueKey) == nil {
+		return nil
+	}
+	item, err := getItem(r)
+	if err != nil {
+		return err
+	}
+	m.Item = &item
+	return nil
+}
+
+func (m ErrorResponse) Encode() b.Dict {
+	return b.D(
+		b.P(ErrorKey, b.L(b.I(m.Code), b.S(m.Message))),
+		b.P(TransactionID, m.TransactionID),
+		b.P(MessageType, ErrorType),
+	)
+}
+
+func (m *ErrorResponse) Decode(d b.Dict) (err error) {
+	if m.TransactionID, err = header(d, ErrorType); err != nil {
+		return err
+	}
+	e, err := d.GetList(ErrorKey)
+	if err != nil {
+		return err
+	}
+	if e.Len() < 2 {
+		return errors.New("error should have a code and a message")
+	}
+	code, ok := e[0].(b.Int)
+	if !ok {
+		return errors.New("error code was not an Int")
+	}
+	msg, ok := e[1].(b.String)
+	if !ok {
+		return errors.New("error message was not a String")
+	}
+	m.Code, m.Message = code.Raw(), msg.Raw()
+	return nil
+}
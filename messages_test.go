@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"dht/bencode"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKRPCMessages(t *testing.T) {
+	id, hash := bencode.S(strings.Repeat("a", BytesInID)), bencode.S(strings.Repeat("b", BytesInID))
+	tid := bencode.S("aa")
+	nodes := Nodes{Node{[]byte(strings.Repeat("c", BytesInID)), net.IP{127, 0, 0, 1}, 6881}}
+	nodes6 := append(nodes, Node{[]byte(strings.Repeat("d", BytesInID)), net.ParseIP("2001:db8::1"), 6881})
+	peers := Peers{NewPeer(net.IP{10, 0, 0, 1}, 51413), NewPeer(net.IP{10, 0, 0, 2}, 6881)}
+	peers6 := append(peers, NewPeer(net.ParseIP("2001:db8::2"), 6881))
+	want := []bencode.String{WantIPv4, WantIPv6}
+	seq, k, sig := int64(4), bencode.S(strings.Repeat("k", 32)), bencode.S(strings.Repeat("s", 64))
+	for _, pair := range [][2]KRPCMessage{
+		{&PingQuery{tid, id}, &PingQuery{}},
+		{&FindNodeQuery{tid, id, hash, nil}, &FindNodeQuery{}},
+		{&FindNodeQuery{tid, id, hash, want}, &FindNodeQuery{}},
+		{&GetPeersQuery{tid, id, hash, nil}, &GetPeersQuery{}},
+		{&GetPeersQuery{tid, id, hash, want[1:]}, &GetPeersQuery{}},
+		{&AnnouncePeerQuery{tid, id, hash, bencode.S("tok"), 6881, true}, &AnnouncePeerQuery{}},
+		{&PingResponse{tid, id}, &PingResponse{}},
+		{&FindNodeResponse{tid, id, nodes}, &FindNodeResponse{}},
+		{&FindNodeResponse{tid, id, nodes6}, &FindNodeResponse{}},
+		{&GetPeersResponse{tid, id, bencode.S("tok"), nil, peers}, &GetPeersResponse{}},
+		{&GetPeersResponse{tid, id, bencode.S("tok"), nodes, nil}, &GetPeersResponse{}},
+		{&GetPeersResponse{tid, id, bencode.S("tok"), nil, peers6}, &GetPeersResponse{}},
+		{&GetPeersResponse{tid, id, bencode.S("tok"), nodes6, nil}, &GetPeersResponse{}},
+		{&GetItemQuery{tid, id, hash, nil}, &GetItemQuery{}},
+		{&GetItemQuery{tid, id, hash, &seq}, &GetItemQuery{}},
+		{&GetItemResponse{tid, id, bencode.S("tok"), nodes, nil}, &GetItemResponse{}},
+		{&GetItemResponse{tid, id, bencode.S("tok"), nodes6, &Item{V: bencode.S("v"), K: k, Seq: seq, Signature: sig}}, &GetItemResponse{}},
+		{&PutItemQuery{tid, id, bencode.S("tok"), Item{V: bencode.L(bencode.I(1))}, nil}, &PutItemQuery{}},
+		{&PutItemQuery{tid, id, bencode.S("tok"), Item{bencode.S("v"), k, bencode.S("salt"), seq, sig}, &seq}, &PutItemQuery{}},
+		{&ErrorResponse{tid, KRPCError{ErrorGeneric, "A Generic Error Ocurred"}}, &ErrorResponse{}},
+	} {
+		in, out := pair[0], pair[1]
+		// extra keys, like the client version, must be ignored
+		d := in.Encode().Set(bencode.S("v"), bencode.S("UT01"))
+		v, err := bencode.DecodeFromBytes(d.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Decode(v.(bencode.Dict)); err != nil {
+			t.Fatal("could not decode", d.String(), err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("message did not survive a round trip %+v %+v", in, out)
+		}
+	}
+}
+
+func TestKRPCMessageErrors(t *testing.T) {
+	for input, msg := range map[string]KRPCMessage{
+		"d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q9:find_node1:t2:aa1:y1:qe":                                                               &PingQuery{},
+		"d1:ad2:id3:abce1:q4:ping1:t2:aa1:y1:qe":                                                                                      &PingQuery{},
+		"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaae1:t2:aa1:y1:qe":                                                                             &PingResponse{},
+		"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes3:abce1:t2:aa1:y1:re":                                                                 &FindNodeResponse{},
+		"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes0:6:nodes626:aaaaaaaaaaaaaaaaaaaaaaaaaae1:t2:aa1:y1:re":                               &FindNodeResponse{},
+		"d1:ad2:id20:aaaaaaaaaaaaaaaaaaaa6:target20:bbbbbbbbbbbbbbbbbbbb4:wantli4eee1:q9:find_node1:t2:aa1:y1:qe":                     &FindNodeQuery{},
+		"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa5:token1:x6:valuesli1eee1:t2:aa1:y1:re":                                                      &GetPeersResponse{},
+		"d1:ad2:id20:aaaaaaaaaaaaaaaaaaaa9:info_hash20:bbbbbbbbbbbbbbbbbbbb4:porti65536e5:token1:xe1:q13:announce_peer1:t2:aa1:y1:qe": &AnnouncePeerQuery{},
+		"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa1:k3:abc5:token1:x1:v1:xe1:t2:aa1:y1:re":                                                     &GetItemResponse{},
+		"d1:eli201ee1:t2:aa1:y1:ee": &ErrorResponse{},
+	} {
+		v, err := bencode.DecodeFromString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msg.Decode(v.(bencode.Dict)); err == nil {
+			t.Fatal("invalid message decoded without error", input)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	b "dht/bencode"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// NodeState is how far a node in a RoutingTable can be trusted, as
+	// described in BEP 5.
+	NodeState int
+	// Pinger checks that n still responds to queries.
+	Pinger func(n Node) error
+	// RoutingTable keeps the nodes that have responded to us in k-buckets
+	// ordered by their XOR distance from our id.
+	RoutingTable struct {
+		id      b.String
+		k       int
+		ping    Pinger
+		now     func() time.Time
+		mu      sync.Mutex
+		buckets [idBits]bucket
+	}
+	bucket struct {
+		// nodes is ordered from the least to the most recently seen node
+		nodes   []*tableNode
+		changed time.Time
+		// pinging is set while the least recently seen node is checked
+		pinging bool
+	}
+	tableNode struct {
+		Node
+		lastSeen time.Time
+		failures int
+	}
+)
+
+const (
+	// NodeGood nodes have been seen recently.
+	NodeGood NodeState = iota
+	// NodeQuestionable nodes have not been seen for a while.
+	NodeQuestionable
+	// NodeBad nodes have failed to respond to several queries in a row.
+	NodeBad
+)
+
+const (
+	// K is the number of nodes in a k-bucket.
+	K               = 8
+	idBits          = BytesInID * bitsInByte
+	goodTimeout     = 15 * time.Minute
+	refreshInterval = 15 * time.Minute
+	maxFailures     = 2
+)
+
+// NewRoutingTable returns an empty table for id with k nodes in each bucket.
+// When a bucket is full ping is used to check that its least recently seen
+// node is still alive before it is replaced, if ping is nil new nodes are
+// only added in place of bad ones.
+func NewRoutingTable(id b.String, k int, ping Pinger) *RoutingTable {
+	return &RoutingTable{id: id, k: k, ping: ping, now: time.Now}
+}
+
+func (rt *RoutingTable) ID() b.String { return rt.id }
+
+// bucketIndex returns the length of the prefix shared by id and other, which
+// is the bucket other belongs in, or -1 when they are the same or other is not
+// a valid id.
+func bucketIndex(id, other []byte) int {
+	if len(id) != len(other) {
+		return -1
+	}
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*bitsInByte + bits.LeadingZeros8(x)
+		}
+	}
+	return -1
+}
+
+// closer reports whether a is closer to target than c by XOR distance.
+func closer(target, a, c []byte) bool {
+	for i := range target {
+		if da, dc := a[i]^target[i], c[i]^target[i]; da != dc {
+			return da < dc
+		}
+	}
+	return false
+}
+
+func sameNode(a, c Node) bool {
+	return bytes.Equal(a.ID, c.ID) && a.IP.Equal(c.IP) && a.port == c.port
+}
+
+func (bk *bucket) find(n Node) int {
+	for i, tn := range bk.nodes {
+		if bytes.Equal(tn.ID, n.ID) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (bk *bucket) index(tn *tableNode) int {
+	for i, other := range bk.nodes {
+		if other == tn {
+			return i
+		}
+	}
+	return -1
+}
+
+// touch moves node i to the end of the bucket as the most recently seen.
+func (bk *bucket) touch(i int) {
+	tn := bk.nodes[i]
+	copy(bk.nodes[i:], bk.nodes[i+1:])
+	bk.nodes[len(bk.nodes)-1] = tn
+}
+
+func (bk *bucket) remove(i int) {
+	copy(bk.nodes[i:], bk.nodes[i+1:])
+	bk.nodes[len(bk.nodes)-1] = nil
+	bk.nodes = bk.nodes[:len(bk.nodes)-1]
+}
+
+func (rt *RoutingTable) state(tn *tableNode, now time.Time) NodeState {
+	switch {
+	case tn.failures >= maxFailures:
+		return NodeBad
+	case now.Sub(tn.lastSeen) < goodTimeout:
+		return NodeGood
+	}
+	return NodeQuestionable
+}
+
+// State returns the state of n and whether it is in the table at all.
+func (rt *RoutingTable) State(n Node) (NodeState, bool) {
+	i := bucketIndex(rt.id, n.ID)
+	if i < 0 {
+		return NodeBad, false
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	bk := &rt.buckets[i]
+	if j := bk.find(n); j >= 0 {
+		return rt.state(bk.nodes[j], rt.now()), true
+	}
+	return NodeBad, false
+}
+
+func (rt *RoutingTable) Len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	ret := 0
+	for i := range rt.buckets {
+		ret += len(rt.buckets[i].nodes)
+	}
+	return ret
+}
+
+// Update records that n responded to one of our queries. Nodes that are not
+// in the table yet are added when their bucket has room or holds a bad node.
+// When the bucket is full of nodes that are not bad its least recently seen
+// node is pinged and replaced by n if it does not respond.
+func (rt *RoutingTable) Update(n Node) {
+	i := bucketIndex(rt.id, n.ID)
+	if i < 0 {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	now, bk := rt.now(), &rt.buckets[i]
+	if j := bk.find(n); j >= 0 {
+		// a node that changed its address is treated with suspicion
+		if tn := bk.nodes[j]; sameNode(tn.Node, n) {
+			tn.lastSeen, tn.failures = now, 0
+			bk.touch(j)
+			bk.changed = now
+		}
+		return
+	}
+	n = Node{append([]byte(nil), n.ID...), append(net.IP(nil), n.IP...), n.port}
+	tn := &tableNode{n, now, 0}
+	if len(bk.nodes) < rt.k {
+		bk.nodes = append(bk.nodes, tn)
+		bk.changed = now
+		return
+	}
+	for j, old := range bk.nodes {
+		if rt.state(old, now) == NodeBad {
+			bk.remove(j)
+			bk.nodes = append(bk.nodes, tn)
+			bk.changed = now
+			return
+		}
+	}
+	if lru := bk.nodes[0]; rt.ping != nil && !bk.pinging && rt.state(lru, now) == NodeQuestionable {
+		bk.pinging = true
+		go rt.challenge(i, lru, tn)
+	}
+}
+
+// challenge pings lru and replaces it with candidate if it does not respond.
+func (rt *RoutingTable) challenge(i int, lru, candidate *tableNode) {
+	err := rt.ping(lru.Node)
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	now, bk := rt.now(), &rt.buckets[i]
+	bk.pinging = false
+	if j := bk.index(lru); j >= 0 {
+		if err == nil {
+			lru.lastSeen, lru.failures = now, 0
+			bk.touch(j)
+			return
+		}
+		bk.remove(j)
+	}
+	if len(bk.nodes) < rt.k && bk.find(candidate.Node) < 0 {
+		bk.nodes = append(bk.nodes, candidate)
+		bk.changed = now
+	}
+}
+
+// Failed records that n did not respond to a query. Nodes that fail too many
+// queries in a row become bad and are replaced by the next new node.
+func (rt *RoutingTable) Failed(n Node) {
+	i := bucketIndex(rt.id, n.ID)
+	if i < 0 {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	bk := &rt.buckets[i]
+	if j := bk.find(n); j >= 0 && sameNode(bk.nodes[j].Node, n) {
+		bk.nodes[j].failures++
+	}
+}
+
+// Closest returns up to k nodes that are not bad ordered by their distance
+// from target, closest first.
+func (rt *RoutingTable) Closest(target b.String, k int) Nodes {
+	if len(target) != BytesInID {
+		return nil
+	}
+	rt.mu.Lock()
+	now, ret := rt.now(), make(Nodes, 0, k)
+	for i := range rt.buckets {
+		for _, tn := range rt.buckets[i].nodes {
+			if rt.state(tn, now) != NodeBad {
+				ret = append(ret, tn.Node)
+			}
+		}
+	}
+	rt.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return closer(target, ret[i].ID, ret[j].ID) })
+	if len(ret) > k {
+		ret = ret[:k]
+	}
+	return ret
+}
+
+// randomID returns a random id that belongs in bucket i of a table for id.
+func randomID(id b.String, i int) b.String {
+	ret := make(b.String, BytesInID)
+	rand.Read(ret)
+	at, bit := i/bitsInByte, i%bitsInByte
+	copy(ret, id[:at])
+	keep, flip := byte(0xff)<<(bitsInByte-bit), byte(0x80)>>bit
+	ret[at] = id[at]&keep | ^id[at]&flip | ret[at]&^(keep|flip)
+	return ret
+}
+
+// staleTargets returns a random id in every bucket that has not changed for
+// refreshInterval, up to the deepest bucket holding any nodes, and marks
+// those buckets as changed.
+func (rt *RoutingTable) staleTargets() []b.String {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	now, depth := rt.now(), 0
+	for i := range rt.buckets {
+		if len(rt.buckets[i].nodes) > 0 {
+			depth = i
+		}
+	}
+	ret := make([]b.String, 0)
+	for i := 0; i <= depth; i++ {
+		if bk := &rt.buckets[i]; now.Sub(bk.changed) >= refreshInterval {
+			bk.changed = now
+			ret = append(ret, randomID(rt.id, i))
+		}
+	}
+	return ret
+}
+
+// Refresh checks the table every interval until ctx is done and calls find
+// with a random id in each bucket that has not changed recently, so that the
+// caller can look up nodes to fill it.
+func (rt *RoutingTable) Refresh(ctx context.Context, interval time.Duration, find func(target b.String)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for _, target := range rt.staleTargets() {
+				find(target)
+			}
+		}
+	}
+}
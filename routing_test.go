@@ -0,0 +1,196 @@
+package dht
+
+import (
+	"context"
+	"dht/bencode"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testID returns an id that is all zeros except for its first byte.
+func testID(first byte, last byte) bencode.String {
+	id := make(bencode.String, BytesInID)
+	id[0], id[BytesInID-1] = first, last
+	return id
+}
+
+func testNode(id bencode.String, port uint16) Node {
+	return Node{id, net.IP{127, 0, 0, 1}, port}
+}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestBucketIndex(t *testing.T) {
+	id := testID(0, 0)
+	for other, expected := range map[byte]int{0x80: 0, 0x40: 1, 0x01: 7} {
+		if i := bucketIndex(id, testID(other, 0)); i != expected {
+			t.Fatal("wrong bucket for", other, i)
+		}
+	}
+	if bucketIndex(id, testID(0, 1)) != idBits-1 || bucketIndex(id, id) != -1 || bucketIndex(id, id[1:]) != -1 {
+		t.Fatal("wrong bucket for closest, same or invalid id")
+	}
+	for i := 0; i < idBits; i++ {
+		if got := bucketIndex(id, randomID(id, i)); got != i {
+			t.Fatal("random id for bucket", i, "was in bucket", got)
+		}
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	rt := NewRoutingTable(testID(0, 0), K, nil)
+	for i := byte(1); i <= 20; i++ {
+		rt.Update(testNode(testID(i, i), uint16(i)))
+	}
+	if rt.Len() != 20 {
+		t.Fatal("table should hold every node", rt.Len())
+	}
+	closest := rt.Closest(testID(0x10, 0), 3)
+	expected := []byte{0x10, 0x11, 0x12}
+	if len(closest) != len(expected) {
+		t.Fatal("wrong number of closest nodes", closest)
+	}
+	for i, n := range closest {
+		if n.ID[0] != expected[i] {
+			t.Fatal("closest nodes in the wrong order", i, n.ID[0])
+		}
+	}
+	if rt.Closest(bencode.S("short"), 3) != nil {
+		t.Fatal("invalid target should not have any closest nodes")
+	}
+}
+
+func TestRoutingTableStates(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	rt := NewRoutingTable(testID(0, 0), 2, nil)
+	rt.now = clock.Now
+	// every node with a first byte of 0x80 or more is in bucket 0
+	a, c, d := testNode(testID(0x80, 1), 1), testNode(testID(0x81, 2), 2), testNode(testID(0x82, 3), 3)
+	rt.Update(a)
+	rt.Update(c)
+	rt.Update(d)
+	if _, ok := rt.State(d); ok {
+		t.Fatal("full bucket of good nodes should not take new nodes")
+	}
+	clock.Add(goodTimeout)
+	if s, _ := rt.State(a); s != NodeQuestionable {
+		t.Fatal("node should be questionable after timeout", s)
+	}
+	rt.Update(a)
+	if s, _ := rt.State(a); s != NodeGood {
+		t.Fatal("node should be good after responding", s)
+	}
+	for i := 0; i < maxFailures; i++ {
+		rt.Failed(c)
+	}
+	if s, _ := rt.State(c); s != NodeBad {
+		t.Fatal("node should be bad after failing queries", s)
+	}
+	if len(rt.Closest(testID(0x80, 0), K)) != 1 {
+		t.Fatal("bad nodes should not be returned")
+	}
+	rt.Update(d)
+	if _, ok := rt.State(c); ok {
+		t.Fatal("bad node should have been replaced")
+	}
+	if s, ok := rt.State(d); !ok || s != NodeGood {
+		t.Fatal("new node should have replaced the bad one")
+	}
+	moved := Node{a.ID, net.IP{10, 0, 0, 1}, 1}
+	clock.Add(goodTimeout)
+	rt.Update(moved)
+	if s, _ := rt.State(a); s != NodeQuestionable {
+		t.Fatal("node that changed address should not be refreshed")
+	}
+}
+
+func TestRoutingTablePingBeforeReplace(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	pinged := make(chan Node)
+	alive := true
+	rt := NewRoutingTable(testID(0, 0), 1, func(n Node) error {
+		pinged <- n
+		if alive {
+			return nil
+		}
+		return errors.New("no response")
+	})
+	rt.now = clock.Now
+	a, c := testNode(testID(0x80, 1), 1), testNode(testID(0x81, 2), 2)
+	rt.Update(a)
+	rt.Update(c)
+	clock.Add(goodTimeout)
+	wait := func(expected Node) {
+		if n := <-pinged; !sameNode(n, expected) {
+			t.Fatal("wrong node pinged", n)
+		}
+		// wait for the challenge to finish updating the bucket
+		for {
+			rt.mu.Lock()
+			done := !rt.buckets[0].pinging
+			rt.mu.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	rt.Update(c)
+	wait(a)
+	if s, ok := rt.State(a); !ok || s != NodeGood {
+		t.Fatal("node that responded to a ping should be kept")
+	}
+	clock.Add(goodTimeout)
+	alive = false
+	rt.Update(c)
+	wait(a)
+	if _, ok := rt.State(a); ok {
+		t.Fatal("node that did not respond to a ping should be replaced")
+	}
+	if _, ok := rt.State(c); !ok {
+		t.Fatal("new node should replace the unresponsive one")
+	}
+}
+
+func TestRoutingTableRefresh(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0).Add(refreshInterval)}
+	id := testID(0, 0)
+	rt := NewRoutingTable(id, K, nil)
+	rt.now = clock.Now
+	rt.Update(testNode(testID(0x10, 0), 1))
+	targets := make(chan bencode.String, idBits)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		rt.Refresh(ctx, time.Millisecond, func(target bencode.String) { targets <- target })
+		close(targets)
+	}()
+	// the node is in bucket 3 so buckets 0 through 2 are empty and stale
+	for i := 0; i < 3; i++ {
+		if target := <-targets; bucketIndex(id, target) != i {
+			t.Fatal("refresh target was in the wrong bucket", bucketIndex(id, target))
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for target := range targets {
+		t.Fatal("fresh bucket was refreshed", bucketIndex(id, target))
+	}
+}
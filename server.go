@@ -0,0 +1,469 @@
+package dht
+
+import (
+	"context"
+	b "dht/bencode"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// Server is a regular BEP 5 DHT node. It answers ping, find_node,
+	// get_peers and announce_peer queries from a RoutingTable of the nodes
+	// that have answered its own queries and stores the peers announced to
+	// it. It also stores items with the get and put queries of BEP 44. A
+	// dual-stack server also queries IPv6 nodes and keeps them in a separate
+	// RoutingTable, as described in BEP 32.
+	Server struct {
+		id      b.String
+		sender  Sender
+		table   *RoutingTable
+		table6  *RoutingTable
+		ipv6    bool
+		queries *TransactionManager
+		tokens  *TokenManager
+		items   *ItemStore
+		now     func() time.Time
+		// announceInterval is how often Announce announces a torrent again
+		announceInterval time.Duration
+		mu               sync.Mutex
+		// peers maps an infohash to the compact form of each peer announced
+		// for it and when it was announced
+		peers map[string]map[string]time.Time
+	}
+)
+
+const (
+	queryTimeout = 5 * time.Second
+	queryRetries = 1
+	// peerTimeout is how long an announced peer is kept.
+	peerTimeout = 30 * time.Minute
+	// maxValues keeps get_peers responses small enough for a UDP packet.
+	maxValues = 50
+	// maxInfohashes and maxPeers bound the number of infohashes peers are
+	// stored for and the number of peers stored for each of them.
+	maxInfohashes = 1 << 14
+	maxPeers      = 1 << 10
+	// peerSweep is how often expired peers are removed.
+	peerSweep = time.Minute
+)
+
+// NewServer returns an IPv4 only Server for the node id that sends its
+// messages with s.
+func NewServer(id b.String, s Sender) (*Server, error) { return newServer(id, s, false) }
+
+// NewDualStackServer returns a Server for the node id that talks to both IPv4
+// and IPv6 nodes, s must be able to send messages to either.
+func NewDualStackServer(id b.String, s Sender) (*Server, error) { return newServer(id, s, true) }
+
+func newServer(id b.String, s Sender, ipv6 bool) (*Server, error) {
+	tokens, err := NewTokenManager(nil)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Server{
+		id:      id,
+		sender:  s,
+		queries: NewTransactionManager(s, queryTimeout, queryRetries),
+		tokens:  tokens,
+		items:   NewItemStore(nil),
+		ipv6:    ipv6,
+		now:     time.Now,
+		peers:   make(map[string]map[string]time.Time),
+
+		announceInterval: AnnounceInterval,
+	}
+	ping := func(n Node) error {
+		_, err := ret.queries.Query(context.Background(), n, &PingQuery{ID: id})
+		return err
+	}
+	ret.table, ret.table6 = NewRoutingTable(id, K, ping), NewRoutingTable(id, K, ping)
+	return ret, nil
+}
+
+func (s *Server) ID() b.String { return s.id }
+
+// Table returns the routing table of IPv4 nodes.
+func (s *Server) Table() *RoutingTable { return s.table }
+
+// Table6 returns the routing table of IPv6 nodes, which stays empty unless s
+// is dual-stack.
+func (s *Server) Table6() *RoutingTable { return s.table6 }
+
+func (s *Server) tableFor(n Node) *RoutingTable {
+	if n.IPv6() {
+		return s.table6
+	}
+	return s.table
+}
+
+// reachable reports whether s sends queries to n.
+func (s *Server) reachable(n Node) bool { return s.ipv6 || !n.IPv6() }
+
+// want returns the address families s asks for in its queries, which are the
+// family of the query unless s is dual-stack.
+func (s *Server) want() []b.String {
+	if s.ipv6 {
+		return []b.String{WantIPv4, WantIPv6}
+	}
+	return nil
+}
+
+// closest returns the nodes closest to target from the tables of the wanted
+// address families.
+func (s *Server) closest(target b.String, v4, v6 bool) Nodes {
+	var ret Nodes
+	if v4 {
+		ret = append(ret, s.table.Closest(target, K)...)
+	}
+	if v6 {
+		ret = append(ret, s.table6.Closest(target, K)...)
+	}
+	return ret
+}
+
+// Register makes mh pass every query, response and error to s.
+func (s *Server) Register(mh MessageHandler) error {
+	if err := mh.RegisterHandler(QueryType, s.HandleQuery); err != nil {
+		return err
+	}
+	if err := mh.RegisterHandler(ResponseType, s.HandleResponse); err != nil {
+		return err
+	}
+	return mh.RegisterHandler(ErrorType, s.HandleResponse)
+}
+
+// Start fills the routing tables with a lookup of our own id starting from
+// bootstrap and keeps their buckets fresh and removes expired peers until ctx
+// is done.
+func (s *Server) Start(ctx context.Context, bootstrap []Node) {
+	go NewLookup(s, s.id, false).Run(ctx, bootstrap)
+	refresh := func(target b.String) {
+		go NewLookup(s, target, false).Run(ctx, nil)
+	}
+	go s.table.Refresh(ctx, time.Minute, refresh)
+	if s.ipv6 {
+		go s.table6.Refresh(ctx, time.Minute, refresh)
+	}
+	go s.sweepPeers(ctx, peerSweep)
+}
+
+// Query sends msg to node and waits for its response. The routing table is
+// updated with whether node responded, using the id node responded with
+// since the id of a bootstrap node is not known in advance.
+func (s *Server) Query(ctx context.Context, node Node, msg KRPCMessage) (b.Dict, error) {
+	d, err := s.queries.Query(ctx, node, msg)
+	switch {
+	case err == nil:
+		if _, r, err := decodeResponse(d); err == nil {
+			if id, err := getID(r, IDKey); err == nil {
+				s.tableFor(node).Update(Node{id, node.IP, node.port})
+			}
+		}
+	case errors.Is(err, ErrTimeout):
+		s.tableFor(node).Failed(node)
+	}
+	return d, err
+}
+
+func (s *Server) Ping(ctx context.Context, node Node) error {
+	_, err := s.Query(ctx, node, &PingQuery{ID: s.id})
+	return err
+}
+
+// FindNode asks node for the nodes closest to target. Every valid node in
+// the response is returned.
+func (s *Server) FindNode(ctx context.Context, node Node, target b.String) (Nodes, error) {
+	d, err := s.Query(ctx, node, &FindNodeQuery{ID: s.id, Target: target, Want: s.want()})
+	if err != nil {
+		return nil, err
+	}
+	r := FindNodeResponse{}
+	if err := r.Decode(d); err != nil {
+		return nil, err
+	}
+	return r.Nodes, nil
+}
+
+// GetPeers asks node for the peers of infohash, or the nodes closest to it
+// when node does not know any.
+func (s *Server) GetPeers(ctx context.Context, node Node, infohash b.String) (GetPeersResponse, error) {
+	r := GetPeersResponse{}
+	d, err := s.Query(ctx, node, &GetPeersQuery{ID: s.id, InfoHash: infohash, Want: s.want()})
+	if err != nil {
+		return r, err
+	}
+	err = r.Decode(d)
+	return r, err
+}
+
+// HandleResponse passes responses and errors to the queries they answer.
+func (s *Server) HandleResponse(req Requester, d b.Dict) error {
+	return s.queries.Handle(req, d)
+}
+
+// HandleQuery answers the query in d, or replies with a KRPC error when it
+// cannot. Queries without a transaction id are dropped since no reply to them
+// could be matched up.
+func (s *Server) HandleQuery(req Requester, d b.Dict) error {
+	t, err := d.GetString(TransactionID)
+	if err != nil {
+		return err
+	}
+	if err := s.handleQuery(req, d); err != nil {
+		SendError(s.sender, req, t, err)
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleQuery(req Requester, d b.Dict) error {
+	query, err := d.GetString(QueryKey)
+	if err != nil {
+		return NewKRPCError(ErrorProtocol, err.Error())
+	}
+	var (
+		msg    KRPCMessage
+		handle func(Requester, KRPCMessage) (b.Dict, error)
+	)
+	switch {
+	case QueryPing.Equal(query):
+		msg, handle = &PingQuery{}, s.ping
+	case QueryFind.Equal(query):
+		msg, handle = &FindNodeQuery{}, s.findNode
+	case QueryGet.Equal(query):
+		msg, handle = &GetPeersQuery{}, s.getPeers
+	case QueryAnnounce.Equal(query):
+		msg, handle = &AnnouncePeerQuery{}, s.announcePeer
+	case QueryGetItem.Equal(query):
+		msg, handle = &GetItemQuery{}, s.getItem
+	case QueryPutItem.Equal(query):
+		msg, handle = &PutItemQuery{}, s.putItem
+	default:
+		return NewKRPCError(ErrorMethodUnknown, "cannot handle query type: "+query.Raw())
+	}
+	if err := msg.Decode(d); err != nil {
+		return NewKRPCError(ErrorProtocol, err.Error())
+	}
+	r, err := handle(req, msg)
+	if err != nil {
+		return err
+	}
+	s.seen(req, d)
+	s.sender.Send(Message{Data: r, Requester: req})
+	return nil
+}
+
+// seen refreshes the querying node when it is already in the routing table,
+// nodes are only added once they have answered one of our own queries.
+func (s *Server) seen(req Requester, d b.Dict) {
+	a, err := d.GetDict(QueryArgs)
+	if err != nil {
+		return
+	}
+	id, err := getID(a, IDKey)
+	if err != nil {
+		return
+	}
+	node, ok := requesterNode(id, req)
+	if !ok {
+		return
+	}
+	table := s.tableFor(node)
+	if _, ok := table.State(node); ok {
+		table.Update(node)
+	}
+}
+
+// requesterNode returns the node with id that sent a message from req.
+func requesterNode(id b.String, req Requester) (Node, bool) {
+	addr, ok := req.Addr().(*net.UDPAddr)
+	if !ok || addr.Port <= 0 || addr.Port >= MaxPort {
+		return Node{}, false
+	}
+	ip := compactIP(addr.IP)
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return Node{}, false
+	}
+	return Node{id, ip, uint16(addr.Port)}, true
+}
+
+// families returns whether the reply to a query from req should hold IPv4
+// and IPv6 nodes. Without a want list only the family of req is sent.
+func families(req Requester, want []b.String) (v4, v6 bool) {
+	if len(want) == 0 {
+		v6 = isIPv6(RequesterIP(req))
+		return !v6, v6
+	}
+	for _, w := range want {
+		v4 = v4 || w.Equal(WantIPv4)
+		v6 = v6 || w.Equal(WantIPv6)
+	}
+	return v4, v6
+}
+
+func (s *Server) ping(_ Requester, msg KRPCMessage) (b.Dict, error) {
+	q := msg.(*PingQuery)
+	return PingResponse{TransactionID: q.TransactionID.Clone(), ID: s.id}.Encode(), nil
+}
+
+func (s *Server) findNode(req Requester, msg KRPCMessage) (b.Dict, error) {
+	q := msg.(*FindNodeQuery)
+	v4, v6 := families(req, q.Want)
+	return FindNodeResponse{
+		TransactionID: q.TransactionID.Clone(),
+		ID:            s.id,
+		Nodes:         s.closest(q.Target, v4, v6),
+	}.Encode(), nil
+}
+
+func (s *Server) getPeers(req Requester, msg KRPCMessage) (b.Dict, error) {
+	q := msg.(*GetPeersQuery)
+	v4, v6 := families(req, q.Want)
+	r := GetPeersResponse{
+		TransactionID: q.TransactionID.Clone(),
+		ID:            s.id,
+		Token:         s.tokens.Token(RequesterIP(req)),
+		Values:        s.peersOf(q.InfoHash, v4, v6),
+	}
+	if len(r.Values) == 0 {
+		r.Nodes = s.closest(q.InfoHash, v4, v6)
+	}
+	return r.Encode(), nil
+}
+
+func (s *Server) announcePeer(req Requester, msg KRPCMessage) (b.Dict, error) {
+	q := msg.(*AnnouncePeerQuery)
+	if !s.tokens.Valid(RequesterIP(req), q.Token) {
+		return nil, NewKRPCError(ErrorProtocol, "invalid token in announce request")
+	}
+	port := q.Port
+	if q.ImpliedPort {
+		port = uint16(req.Port())
+	}
+	if err := s.AddPeer(q.InfoHash, NewPeer(RequesterIP(req), port)); err != nil {
+		return nil, err
+	}
+	return AnnouncePeerResponse{TransactionID: q.TransactionID.Clone(), ID: s.id}.Encode(), nil
+}
+
+func (s *Server) getItem(req Requester, msg KRPCMessage) (b.Dict, error) {
+	q := msg.(*GetItemQuery)
+	v4, v6 := families(req, nil)
+	r := GetItemResponse{
+		TransactionID: q.TransactionID.Clone(),
+		ID:            s.id,
+		Token:         s.tokens.Token(RequesterIP(req)),
+		Nodes:         s.closest(q.Target, v4, v6),
+	}
+	// seq only applies to mutable items
+	if item, ok := s.items.Get(q.Target); ok && (!item.Mutable() || q.Seq == nil || item.Seq > *q.Seq) {
+		r.Item = &item
+	}
+	return r.Encode(), nil
+}
+
+func (s *Server) putItem(req Requester, msg KRPCMessage) (b.Dict, error) {
+	q := msg.(*PutItemQuery)
+	if !s.tokens.Valid(RequesterIP(req), q.Token) {
+		return nil, NewKRPCError(ErrorProtocol, "invalid token in put request")
+	}
+	if err := s.items.Put(q.Item, q.CAS); err != nil {
+		return nil, err
+	}
+	return PutItemResponse{TransactionID: q.TransactionID.Clone(), ID: s.id}.Encode(), nil
+}
+
+// AddPeer stores p as a peer of infohash until it expires. When there is no
+// room for it even after removing the expired peers it is not stored and a
+// KRPCError is returned.
+func (s *Server) AddPeer(infohash b.String, p Peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now, raw := s.now(), p.String()
+	peers := s.peers[infohash.Raw()]
+	if peers == nil && len(s.peers) >= maxInfohashes {
+		s.expirePeers(now)
+		if len(s.peers) >= maxInfohashes {
+			return NewKRPCError(ErrorServer, "peer store is full")
+		}
+	}
+	if _, ok := peers[raw]; !ok && len(peers) >= maxPeers {
+		dropExpired(peers, now)
+		if len(peers) >= maxPeers {
+			return NewKRPCError(ErrorServer, "infohash has too many peers")
+		}
+	}
+	if peers == nil {
+		peers = make(map[string]time.Time)
+		s.peers[infohash.Raw()] = peers
+	}
+	peers[raw] = now
+	return nil
+}
+
+// Peers returns up to maxValues peers announced for infohash that have not
+// expired, removing those that have.
+func (s *Server) Peers(infohash b.String) Peers { return s.peersOf(infohash, true, true) }
+
+// peersOf returns the peers of infohash like Peers but only those of the
+// wanted address families.
+func (s *Server) peersOf(infohash b.String, v4, v6 bool) Peers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, now := s.peers[infohash.Raw()], s.now()
+	ret := make(Peers, 0, len(peers))
+	for raw, announced := range peers {
+		if now.Sub(announced) >= peerTimeout {
+			delete(peers, raw)
+			continue
+		}
+		if len(ret) < maxValues {
+			if p, err := ParsePeer([]byte(raw)); err == nil && (p.IPv6() && v6 || !p.IPv6() && v4) {
+				ret = append(ret, p)
+			}
+		}
+	}
+	if len(peers) == 0 {
+		delete(s.peers, infohash.Raw())
+	}
+	return ret
+}
+
+// sweepPeers removes the expired peers every interval until ctx is done, so
+// that the peers of infohashes nobody asks for again do not pile up.
+func (s *Server) sweepPeers(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.mu.Lock()
+			s.expirePeers(s.now())
+			s.mu.Unlock()
+		}
+	}
+}
+
+// expirePeers removes the expired peers of every infohash, s.mu must be held.
+func (s *Server) expirePeers(now time.Time) {
+	for infohash, peers := range s.peers {
+		if dropExpired(peers, now); len(peers) == 0 {
+			delete(s.peers, infohash)
+		}
+	}
+}
+
+// dropExpired removes the peers that were announced at least peerTimeout
+// before now.
+func dropExpired(peers map[string]time.Time, now time.Time) {
+	for raw, announced := range peers {
+		if now.Sub(announced) >= peerTimeout {
+			delete(peers, raw)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package dht
+
+import (
+	"context"
+	"dht/bencode"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeSender delivers every message to the server listening on its address,
+// as if it had been sent from the address of from.
+type pipeSender struct {
+	from    UDPRequester
+	servers map[string]*Server
+}
+
+func (s *pipeSender) Send(m Message) {
+	to := s.servers[m.Requester.Addr().String()]
+	if to == nil {
+		return
+	}
+	d := bencode.Clone(m.Data).(bencode.Dict)
+	go func() {
+		mt, _ := d.GetString(MessageType)
+		if mt.Equal(QueryType) {
+			to.HandleQuery(s.from, d)
+		} else {
+			to.HandleResponse(s.from, d)
+		}
+	}()
+}
+
+// testServers returns n servers that can reach each other over pipeSenders
+// along with the node of each.
+func testServers(t *testing.T, n int) ([]*Server, Nodes) {
+	ips := make([]net.IP, n)
+	for i := range ips {
+		// tokens are tied to an ip so every server needs its own
+		ips[i] = net.IP{127, 0, 0, byte(i + 1)}
+	}
+	return testServersAt(t, NewServer, ips...)
+}
+
+// testServersAt returns a server made by newServer for each ip, ordered by
+// their ids.
+func testServersAt(t *testing.T, newServer func(bencode.String, Sender) (*Server, error), ips ...net.IP) ([]*Server, Nodes) {
+	n := len(ips)
+	servers, nodes, byAddr := make([]*Server, n), make(Nodes, n), make(map[string]*Server)
+	for i := range servers {
+		nodes[i] = Node{testID(byte((i+1)*256/(n+1)), byte(i)), ips[i], 6881}
+		srv, err := newServer(nodes[i].ID, &pipeSender{UDPRequester{nodes[i].Addr().(*net.UDPAddr)}, byAddr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = srv
+		byAddr[nodes[i].Addr().String()] = srv
+	}
+	return servers, nodes
+}
+
+func TestServerQueries(t *testing.T) {
+	servers, nodes := testServers(t, 3)
+	ctx := context.Background()
+	if err := servers[0].Ping(ctx, nodes[1]); err != nil {
+		t.Fatal("ping failed", err)
+	}
+	if _, ok := servers[0].Table().State(nodes[1]); !ok {
+		t.Fatal("node that answered a ping should be in the table")
+	}
+	if err := servers[1].Ping(ctx, nodes[2]); err != nil {
+		t.Fatal("ping failed", err)
+	}
+	found, err := servers[0].FindNode(ctx, nodes[1], nodes[2].ID)
+	if err != nil {
+		t.Fatal("find_node failed", err)
+	}
+	if len(found) != 1 || !sameNode(found[0], nodes[2]) {
+		t.Fatal("find_node returned the wrong nodes", found)
+	}
+	infohash := testID(0x30, 0xff)
+	r, err := servers[0].GetPeers(ctx, nodes[1], infohash)
+	if err != nil {
+		t.Fatal("get_peers failed", err)
+	}
+	if len(r.Values) != 0 || len(r.Nodes) != 1 || r.Token.Len() != tokenSize {
+		t.Fatal("get_peers without peers should return nodes and a token", r)
+	}
+	announce := &AnnouncePeerQuery{ID: nodes[0].ID, InfoHash: infohash, Token: r.Token, ImpliedPort: true}
+	if _, err := servers[0].Query(ctx, nodes[1], announce); err != nil {
+		t.Fatal("announce_peer failed", err)
+	}
+	r, err = servers[2].GetPeers(ctx, nodes[1], infohash)
+	if err != nil {
+		t.Fatal("get_peers failed", err)
+	}
+	if len(r.Values) != 1 || r.Values[0].String() != NewPeer(nodes[0].IP, uint16(nodes[0].Port())).String() {
+		t.Fatal("announced peer was not returned", r.Values)
+	}
+	announce.Token = r.Token
+	if _, err := servers[0].Query(ctx, nodes[1], announce); err == nil {
+		t.Fatal("announce with the token of another node should fail")
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	s := &sendRecorder{}
+	srv, err := NewServer(testID(0x10, 0), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := UDPRequester{&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}}
+	for raw, expected := range map[string]int64{
+		"d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q4:vote1:t2:aa1:y1:qe":                                                                 ErrorMethodUnknown,
+		"d1:ad2:id3:aaae1:q4:ping1:t2:aa1:y1:qe":                                                                                   ErrorProtocol,
+		"d1:ad2:id20:aaaaaaaaaaaaaaaaaaaa9:info_hash20:bbbbbbbbbbbbbbbbbbbb4:porti1e5:token2:bbe1:q13:announce_peer1:t2:aa1:y1:qe": ErrorProtocol,
+	} {
+		s.sent = nil
+		d, err := bencode.NewBytesDecoder([]byte(raw)).Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if srv.HandleQuery(req, d.(bencode.Dict)) == nil || len(s.sent) != 1 {
+			t.Fatal("query should have been answered with an error", raw)
+		}
+		m := ErrorResponse{}
+		if err := m.Decode(s.sent[0].Data); err != nil || m.Code != expected {
+			t.Fatal("wrong error sent for", raw, m.Code, err)
+		}
+	}
+}
+
+func TestServerPeersExpire(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	srv, err := NewServer(testID(0x10, 0), &sendRecorder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.now = clock.Now
+	infohash := testID(0x20, 0)
+	for i := 0; i < maxValues+10; i++ {
+		srv.AddPeer(infohash, NewPeer(net.IP{127, 0, 0, byte(i)}, 6881))
+	}
+	if len(srv.Peers(infohash)) != maxValues {
+		t.Fatal("wrong number of peers returned")
+	}
+	clock.Add(peerTimeout)
+	if len(srv.Peers(infohash)) != 0 || len(srv.peers) != 0 {
+		t.Fatal("peers should have expired")
+	}
+	srv.AddPeer(testID(0x30, 0), NewPeer(net.IP{127, 0, 0, 1}, 6881))
+	clock.Add(peerTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.sweepPeers(ctx, time.Millisecond)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		srv.mu.Lock()
+		n := len(srv.peers)
+		srv.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("peers of an infohash nobody asked for were not swept")
+		}
+	}
+}
+
+func TestServerPeersLimits(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	srv, err := NewServer(testID(0x10, 0), &sendRecorder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.now = clock.Now
+	infohash := testID(0x20, 0)
+	peer := func(i int) Peer { return NewPeer(net.IP{10, 0, byte(i >> 8), byte(i)}, 6881) }
+	for i := 0; i < maxPeers; i++ {
+		if err := srv.AddPeer(infohash, peer(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.AddPeer(infohash, peer(maxPeers)); err == nil {
+		t.Fatal("infohash should not take more than maxPeers peers")
+	}
+	if err := srv.AddPeer(infohash, peer(0)); err != nil {
+		t.Fatal("a stored peer should be refreshed when the infohash is full", err)
+	}
+	for i := 1; len(srv.peers) < maxInfohashes; i++ {
+		id := testID(0x30, byte(i))
+		id[1] = byte(i >> 8)
+		if err := srv.AddPeer(id, peer(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.AddPeer(testID(0x40, 0), peer(0)); err == nil {
+		t.Fatal("no more than maxInfohashes infohashes should be stored")
+	}
+	clock.Add(peerTimeout)
+	if err := srv.AddPeer(testID(0x40, 0), peer(0)); err != nil || len(srv.peers) != 1 {
+		t.Fatal("expired peers should make room", err, len(srv.peers))
+	}
+}
+
+func TestServerDualStack(t *testing.T) {
+	v6 := net.ParseIP("2001:db8::1")
+	servers, nodes := testServersAt(t, NewDualStackServer, net.IP{10, 0, 0, 1}, v6, net.IP{10, 0, 0, 2})
+	ctx := context.Background()
+	for _, n := range nodes[1:] {
+		if err := servers[0].Ping(ctx, n); err != nil {
+			t.Fatal("ping failed", err)
+		}
+	}
+	if servers[0].Table().Len() != 1 || servers[0].Table6().Len() != 1 {
+		t.Fatal("nodes should be kept in the table of their address family")
+	}
+	found, err := servers[2].FindNode(ctx, nodes[0], nodes[1].ID)
+	if err != nil {
+		t.Fatal("find_node failed", err)
+	}
+	if len(found) != 2 || !found[1].IPv6() || !sameNode(found[1], nodes[1]) {
+		t.Fatal("dual-stack find_node should return nodes of both families", found)
+	}
+	infohash := testID(0xff, 0xff)
+	servers[0].AddPeer(infohash, NewPeer(net.IP{10, 0, 0, 3}, 6881))
+	servers[0].AddPeer(infohash, NewPeer(net.ParseIP("2001:db8::3"), 6881))
+	s := &sendRecorder{}
+	servers[0].sender = s
+	for want, expected := range map[string][2]int{
+		"":                 {0, 1},
+		"4:wantl2:n4e":     {1, 0},
+		"4:wantl2:n42:n6e": {1, 1},
+	} {
+		s.sent = nil
+		raw := "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaa9:info_hash20:" + infohash.Raw() + want + "e1:q9:get_peers1:t2:aa1:y1:qe"
+		d, err := bencode.NewBytesDecoder([]byte(raw)).Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := servers[0].HandleQuery(UDPRequester{&net.UDPAddr{IP: v6, Port: 6881}}, d.(bencode.Dict)); err != nil {
+			t.Fatal(err)
+		}
+		r := GetPeersResponse{}
+		if err := r.Decode(s.sent[0].Data); err != nil {
+			t.Fatal(err)
+		}
+		counts := [2]int{}
+		for _, p := range r.Values {
+			if p.IPv6() {
+				counts[1]++
+			} else {
+				counts[0]++
+			}
+		}
+		if counts != expected {
+			t.Fatal("wrong families of peers returned for want", want, r.Values)
+		}
+	}
+	only4, _ := testServers(t, 1)
+	if r, err := NewLookup(only4[0], nodes[1].ID, false).Run(ctx, nodes[1:2]); err != nil || len(r.Closest) != 0 {
+		t.Fatal("IPv4 only server should not query IPv6 nodes", r, err)
+	}
+}
@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"context"
+	b "dht/bencode"
+	"errors"
+)
+
+var ErrNotStored = errors.New("dht: no node accepted the item")
+
+// GetItem asks node for the item stored under target, only if its sequence
+// number is higher than seq when that is set. The item in the response is not
+// verified.
+func (s *Server) GetItem(ctx context.Context, node Node, target b.String, seq *int64) (GetItemResponse, error) {
+	r := GetItemResponse{}
+	d, err := s.Query(ctx, node, &GetItemQuery{ID: s.id, Target: target, Seq: seq})
+	if err != nil {
+		return r, err
+	}
+	err = r.Decode(d)
+	return r, err
+}
+
+// GetImmutable looks up the immutable item whose value has the SHA-1 target.
+func (s *Server) GetImmutable(ctx context.Context, target b.String) (Item, error) {
+	return s.lookupItem(ctx, target, nil)
+}
+
+// GetMutable looks up the mutable item with the public key k and salt,
+// returning the one with the highest sequence number that any node has.
+func (s *Server) GetMutable(ctx context.Context, k, salt b.String) (Item, error) {
+	return s.lookupItem(ctx, MutableTarget(k, salt), salt)
+}
+
+func (s *Server) lookupItem(ctx context.Context, target, salt b.String) (Item, error) {
+	r, err := NewItemLookup(s, target, salt).Run(ctx, nil)
+	if err != nil {
+		return Item{}, err
+	}
+	if r.Item == nil {
+		return Item{}, ErrItemNotFound
+	}
+	return *r.Item, nil
+}
+
+// Put stores item on the nodes closest to its target and returns the number
+// of nodes that accepted it. When cas is set a mutable item is only stored by
+// nodes whose copy has that sequence number.
+func (s *Server) Put(ctx context.Context, item Item, cas *int64) (int, error) {
+	if err := item.Verify(); err != nil {
+		return 0, err
+	}
+	r, err := NewItemLookup(s, item.Target(), item.Salt).Run(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	stored := s.queryAll(ctx, r.Closest, func(n LookupNode) KRPCMessage {
+		return &PutItemQuery{ID: s.id, Token: n.Token, Item: item, CAS: cas}
+	})
+	if stored == 0 {
+		return 0, ErrNotStored
+	}
+	return stored, nil
+}
@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"dht/bencode"
+	"testing"
+)
+
+func TestPutGetImmutable(t *testing.T) {
+	servers, _ := testNetwork(t, 30)
+	ctx := context.Background()
+	item := NewImmutableItem(bencode.D(bencode.P(bencode.S("status"), bencode.S("ok"))))
+	n, err := servers[0].Put(ctx, item, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != K {
+		t.Fatal("item should be stored on the k closest nodes", n)
+	}
+	found, err := servers[20].GetImmutable(ctx, item.Target())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.V.String() != item.V.String() {
+		t.Fatal("wrong item found", found.V)
+	}
+	if _, err := servers[20].GetImmutable(ctx, testID(0x42, 0x42)); err != ErrItemNotFound {
+		t.Fatal("missing item should not be found", err)
+	}
+}
+
+func TestPutGetMutable(t *testing.T) {
+	servers, _ := testNetwork(t, 30)
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := bencode.S("beacon")
+	if _, err := servers[0].Put(ctx, NewMutableItem(priv, salt, 1, bencode.S("first")), nil); err != nil {
+		t.Fatal(err)
+	}
+	one := int64(1)
+	if _, err := servers[5].Put(ctx, NewMutableItem(priv, salt, 2, bencode.S("second")), &one); err != nil {
+		t.Fatal(err)
+	}
+	found, err := servers[20].GetMutable(ctx, bencode.String(pub), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Seq != 2 || found.V.String() != "6:second" {
+		t.Fatal("newest item was not found", found.Seq, found.V)
+	}
+	holders := make(map[*Server]bool)
+	for _, s := range servers {
+		if i, ok := s.items.Get(found.Target()); ok && i.Seq == 2 {
+			holders[s] = true
+		}
+	}
+	if len(holders) == 0 {
+		t.Fatal("no node holds the item")
+	}
+	// a node the lookup only found now has no item to compare cas against, so
+	// it may accept the put, but every node holding seq 2 must reject it
+	servers[5].Put(ctx, NewMutableItem(priv, salt, 3, bencode.S("third")), &one)
+	for s := range holders {
+		if i, _ := s.items.Get(found.Target()); i.Seq != 2 {
+			t.Fatal("put with a stale cas should not be stored", i.Seq)
+		}
+	}
+	if _, err := servers[20].GetMutable(ctx, bencode.String(pub), bencode.S("other")); err != ErrItemNotFound {
+		t.Fatal("item with another salt should not be found", err)
+	}
+	if _, err := servers[0].Put(ctx, Item{V: bencode.S("forged"), K: bencode.String(pub), Seq: 9, Signature: found.Signature}, nil); err == nil {
+		t.Fatal("item with an invalid signature should not be put")
+	}
+}
+
+func TestGetItemSeq(t *testing.T) {
+	servers, nodes := testServers(t, 2)
+	ctx := context.Background()
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	immutable, mutable := NewImmutableItem(bencode.S("fixed")), NewMutableItem(priv, nil, 3, bencode.S("changing"))
+	for _, item := range []Item{immutable, mutable} {
+		if err := servers[1].items.Put(item, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := int64(3)
+	r, err := servers[0].GetItem(ctx, nodes[1], immutable.Target(), &seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Item == nil || r.Item.V.String() != "5:fixed" {
+		t.Fatal("immutable item should be returned whatever the seq", r.Item)
+	}
+	if r, err = servers[0].GetItem(ctx, nodes[1], mutable.Target(), &seq); err != nil || r.Item != nil {
+		t.Fatal("mutable item that is not newer than seq should not be returned", r.Item, err)
+	}
+	seq = 2
+	if r, err = servers[0].GetItem(ctx, nodes[1], mutable.Target(), &seq); err != nil || r.Item == nil || r.Item.Seq != 3 {
+		t.Fatal("newer mutable item should be returned", r.Item, err)
+	}
+}
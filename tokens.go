@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	b "dht/bencode"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+type (
+	// TokenManager hands out the tokens sent in get_peers responses and
+	// checks the tokens sent back in announce_peer queries. A token is an
+	// HMAC/SHA-1 of the requester's ip and a secret that rotates every
+	// TokenRotation, tokens made with the current or the previous secret are
+	// accepted.
+	TokenManager struct {
+		key []byte
+		now func() time.Time
+	}
+)
+
+const (
+	// TokenRotation is how often the secret used for tokens changes.
+	TokenRotation = 5 * time.Minute
+	tokenSize     = 8
+)
+
+// NewTokenManager returns a TokenManager that reads the time from now, which
+// defaults to time.Now when nil.
+func NewTokenManager(now func() time.Time) (*TokenManager, error) {
+	key := make([]byte, sha1.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if now == nil {
+		now = time.Now
+	}
+	return &TokenManager{key, now}, nil
+}
+
+// secret returns the secret for the epoch-th rotation period, secrets are
+// derived from the key so that rotating them never needs new randomness.
+func (tm *TokenManager) secret(epoch int64) []byte {
+	mac := hmac.New(sha1.New, tm.key)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(epoch))
+	mac.Write(buf)
+	return mac.Sum(nil)
+}
+
+func (tm *TokenManager) epoch() int64 {
+	return tm.now().UnixNano() / int64(TokenRotation)
+}
+
+func (tm *TokenManager) token(ip net.IP, epoch int64) b.String {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac := hmac.New(sha1.New, tm.secret(epoch))
+	mac.Write(ip)
+	return mac.Sum(nil)[:tokenSize]
+}
+
+// Token returns the token a node at ip must send back to announce itself.
+func (tm *TokenManager) Token(ip net.IP) b.String {
+	return tm.token(ip, tm.epoch())
+}
+
+// Valid reports whether token was handed out to ip within the last two
+// rotations.
+func (tm *TokenManager) Valid(ip net.IP, token b.String) bool {
+	epoch := tm.epoch()
+	return hmac.Equal(tm.token(ip, epoch), token) || hmac.Equal(tm.token(ip, epoch-1), token)
+}
@@ -0,0 +1,44 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenManager(t *testing.T) {
+	now := time.Unix(0, 0)
+	tm, err := NewTokenManager(func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, other := net.IP{127, 0, 0, 1}, net.IP{127, 0, 0, 2}
+	token := tm.Token(ip)
+	if token.Len() != tokenSize || !tm.Token(ip).Equal(token) {
+		t.Fatal("token should be stable within a rotation", token)
+	}
+	if !tm.Valid(ip.To16(), token) {
+		t.Fatal("token should be valid for the same ip in either form")
+	}
+	if tm.Valid(other, token) || tm.Token(other).Equal(token) {
+		t.Fatal("token should only be valid for the ip it was made for")
+	}
+	now = now.Add(TokenRotation)
+	if !tm.Valid(ip, token) {
+		t.Fatal("token from the previous rotation should be valid")
+	}
+	if tm.Token(ip).Equal(token) {
+		t.Fatal("token should change once the secret rotates")
+	}
+	now = now.Add(TokenRotation)
+	if tm.Valid(ip, token) {
+		t.Fatal("token older than two rotations should not be valid")
+	}
+	tm2, err := NewTokenManager(func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm2.Valid(ip, tm.Token(ip)) {
+		t.Fatal("token should not be valid for another manager")
+	}
+}
@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"context"
+	b "dht/bencode"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// TransactionManager sends queries to other nodes and matches the
+	// responses and errors they send back to the query they answer.
+	TransactionManager struct {
+		sender  Sender
+		timeout time.Duration
+		retries int
+		mu      sync.Mutex
+		next    uint16
+		pending map[string]*transaction
+	}
+	// PendingQuery is a query that is waiting for a reply.
+	PendingQuery struct {
+		ID    b.String
+		Node  Requester
+		Query b.Dict
+		// Deadline is when the current attempt at the query times out.
+		Deadline time.Time
+	}
+	transaction struct {
+		id       b.String
+		node     Requester
+		query    b.Dict
+		deadline time.Time
+		done     chan result
+	}
+	result struct {
+		d   b.Dict
+		err error
+	}
+)
+
+var (
+	ErrTimeout     = errors.New("dht: query timed out")
+	ErrUnsolicited = errors.New("dht: message does not answer a pending query")
+)
+
+const (
+	transactionIDSize = 2
+)
+
+// NewTransactionManager returns a TransactionManager that sends queries with
+// s and waits timeout for each reply, resending a query up to retries times
+// before giving up on it.
+func NewTransactionManager(s Sender, timeout time.Duration, retries int) *TransactionManager {
+	return &TransactionManager{
+		sender:  s,
+		timeout: timeout,
+		retries: retries,
+		pending: make(map[string]*transaction),
+	}
+}
+
+// Pending returns the number of queries waiting for a reply.
+func (tm *TransactionManager) Pending() int {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return len(tm.pending)
+}
+
+// PendingQueries returns every query waiting for a reply.
+func (tm *TransactionManager) PendingQueries() []PendingQuery {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	ret := make([]PendingQuery, 0, len(tm.pending))
+	for _, tx := range tm.pending {
+		ret = append(ret, PendingQuery{tx.id.Clone(), tx.node, tx.query, tx.deadline})
+	}
+	return ret
+}
+
+// begin allocates an unused transaction id for msg and stores it as pending.
+func (tm *TransactionManager) begin(node Requester, msg KRPCMessage) (*transaction, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if len(tm.pending) > math.MaxUint16 {
+		return nil, errors.New("dht: too many pending queries")
+	}
+	id := make(b.String, transactionIDSize)
+	for {
+		id[0], id[1] = byte(tm.next>>8), byte(tm.next)
+		tm.next++
+		if _, ok := tm.pending[string(id)]; !ok {
+			break
+		}
+	}
+	tx := &transaction{
+		id:       id,
+		node:     node,
+		query:    msg.Encode().Set(TransactionID, id),
+		deadline: time.Now().Add(tm.timeout),
+		done:     make(chan result, 1),
+	}
+	tm.pending[string(id)] = tx
+	return tx, nil
+}
+
+func (tm *TransactionManager) finish(tx *transaction) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.pending[string(tx.id)] == tx {
+		delete(tm.pending, string(tx.id))
+	}
+}
+
+// attempt moves the deadline of tx one timeout away for a new attempt at it
+// and returns a timer that fires at the deadline.
+func (tm *TransactionManager) attempt(tx *transaction) *time.Timer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tx.deadline = time.Now().Add(tm.timeout)
+	return time.NewTimer(time.Until(tx.deadline))
+}
+
+// Query sends msg to node and waits for its response, which is returned as
+// is. The transaction id of msg is replaced by one allocated for the query.
+// An error reply is returned as a *KRPCError.
+func (tm *TransactionManager) Query(ctx context.Context, node Requester, msg KRPCMessage) (b.Dict, error) {
+	tx, err := tm.begin(node, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer tm.finish(tx)
+	for attempt := 0; attempt <= tm.retries; attempt++ {
+		timer := tm.attempt(tx)
+		tm.sender.Send(Message{Data: tx.query, Requester: node})
+		select {
+		case res := <-tx.done:
+			timer.Stop()
+			return res.d, res.err
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil, ErrTimeout
+}
+
+// Handle passes the response or error in d to the query it answers. It is a
+// Handler for both ResponseType and ErrorType messages and rejects messages
+// that do not come from the node a pending query was sent to.
+func (tm *TransactionManager) Handle(req Requester, d b.Dict) error {
+	t, err := d.GetString(TransactionID)
+	if err != nil {
+		return err
+	}
+	tm.mu.Lock()
+	tx := tm.pending[string(t)]
+	if tx != nil && tx.node.Addr().String() == req.Addr().String() {
+		delete(tm.pending, string(t))
+	} else {
+		tx = nil
+	}
+	tm.mu.Unlock()
+	if tx == nil {
+		return ErrUnsolicited
+	}
+	// d may alias a buffer that is reused once this returns
+	res := result{d: b.Clone(d).(b.Dict)}
+	if mt, err := d.GetString(MessageType); err == nil && mt.Equal(ErrorType) {
+		res.err = ReceiveError(req, res.d)
+	}
+	tx.done <- res
+	return nil
+}
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"context"
+	"dht/bencode"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replySender answers every query it is sent by calling reply with it.
+type replySender struct {
+	mu    sync.Mutex
+	sent  int
+	reply func(Message)
+}
+
+func (s *replySender) Send(m Message) {
+	s.mu.Lock()
+	s.sent++
+	s.mu.Unlock()
+	if s.reply != nil {
+		go s.reply(m)
+	}
+}
+
+func (s *replySender) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+func TestTransactionManagerQuery(t *testing.T) {
+	node := Node{[]byte(strings.Repeat("a", BytesInID)), net.IP{127, 0, 0, 1}, 6881}
+	id := bencode.S(strings.Repeat("b", BytesInID))
+	s := &replySender{}
+	tm := NewTransactionManager(s, time.Second, 0)
+	s.reply = func(m Message) {
+		q := PingQuery{}
+		if err := q.Decode(m.Data); err != nil {
+			t.Error("query was not sent correctly", err)
+			return
+		}
+		resp := PingResponse{q.TransactionID, id}.Encode()
+		if q.ID.Equal(id) {
+			resp = ErrorResponse{q.TransactionID, KRPCError{ErrorGeneric, "failed"}}.Encode()
+		}
+		if err := tm.Handle(UDPRequester{m.Requester.Addr().(*net.UDPAddr)}, resp); err != nil {
+			t.Error("response was not matched", err)
+		}
+	}
+	d, err := tm.Query(context.Background(), node, &PingQuery{ID: bencode.S(strings.Repeat("c", BytesInID))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := PingResponse{}
+	if err := r.Decode(d); err != nil || !r.ID.Equal(id) {
+		t.Fatal("wrong response returned", d, err)
+	}
+	_, err = tm.Query(context.Background(), node, &PingQuery{ID: id})
+	var ke *KRPCError
+	if !errors.As(err, &ke) || ke.Code != ErrorGeneric {
+		t.Fatal("error reply was not returned as a KRPCError", err)
+	}
+	if tm.Pending() != 0 {
+		t.Fatal("finished queries should not be pending")
+	}
+}
+
+func TestTransactionManagerTimeout(t *testing.T) {
+	node := Node{[]byte(strings.Repeat("a", BytesInID)), net.IP{127, 0, 0, 1}, 6881}
+	s := &replySender{}
+	tm := NewTransactionManager(s, time.Millisecond, 2)
+	if _, err := tm.Query(context.Background(), node, &PingQuery{}); err != ErrTimeout {
+		t.Fatal("expected timeout but got", err)
+	}
+	if s.count() != 3 {
+		t.Fatal("query should have been sent once and retried twice but was sent", s.count())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tm = NewTransactionManager(s, time.Hour, 0)
+	if _, err := tm.Query(ctx, node, &PingQuery{}); err != context.Canceled {
+		t.Fatal("expected cancellation but got", err)
+	}
+}
+
+func TestTransactionManagerUnsolicited(t *testing.T) {
+	node := Node{[]byte(strings.Repeat("a", BytesInID)), net.IP{127, 0, 0, 1}, 6881}
+	other := UDPRequester{&net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 6881}}
+	s := &replySender{}
+	tm := NewTransactionManager(s, time.Second, 0)
+	s.reply = func(m Message) {
+		q := PingQuery{}
+		q.Decode(m.Data)
+		resp := PingResponse{q.TransactionID, bencode.S(strings.Repeat("b", BytesInID))}.Encode()
+		if err := tm.Handle(other, resp); err != ErrUnsolicited {
+			t.Error("response from the wrong node was accepted", err)
+		}
+		resp = resp.Set(TransactionID, bencode.S("zz"))
+		if err := tm.Handle(node, resp); err != ErrUnsolicited {
+			t.Error("response with an unknown transaction id was accepted", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := tm.Query(ctx, node, &PingQuery{}); err != context.DeadlineExceeded {
+		t.Fatal("unsolicited responses should not answer the query", err)
+	}
+}
+
+func TestTransactionManagerPendingQueries(t *testing.T) {
+	node := Node{[]byte(strings.Repeat("a", BytesInID)), net.IP{127, 0, 0, 1}, 6881}
+	tm := NewTransactionManager(&replySender{}, time.Hour, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		_, err := tm.Query(ctx, node, &PingQuery{})
+		done <- err
+	}()
+	for tm.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	pending := tm.PendingQueries()
+	if len(pending) != 1 || pending[0].Node.Addr().String() != node.Addr().String() {
+		t.Fatal("query should be pending", pending)
+	}
+	p := pending[0]
+	if id, err := p.Query.GetString(TransactionID); err != nil || !id.Equal(p.ID) {
+		t.Fatal("pending query has the wrong transaction id", p.ID, id, err)
+	}
+	if p.Deadline.Before(start.Add(time.Hour)) || p.Deadline.After(time.Now().Add(time.Hour)) {
+		t.Fatal("pending query should time out one timeout after it was sent", p.Deadline)
+	}
+	cancel()
+	<-done
+	if len(tm.PendingQueries()) != 0 {
+		t.Fatal("cancelled query should not be pending")
+	}
+}